@@ -1,10 +1,29 @@
 package main
 
 import (
+	"os"
+
 	"github.com/gladiusio/gladius-edged/edged"
+	"github.com/rs/zerolog/log"
 )
 
 // Main - entry-point for the service
 func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "export":
+			err = edged.Export(os.Args[2:])
+		case "import":
+			err = edged.Import(os.Args[2:])
+		default:
+			log.Fatal().Msg("Unknown command: " + os.Args[1] + ", expected export or import")
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error running " + os.Args[1])
+		}
+		return
+	}
+
 	edged.Run()
 }
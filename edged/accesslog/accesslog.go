@@ -0,0 +1,187 @@
+// Package accesslog writes a log of the requests to the content server, as
+// JSON or in the Combined Log Format, to a file that is rotated by size and
+// time
+package accesslog
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log formats
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+)
+
+// Entry is a single request
+type Entry struct {
+	Time      time.Time
+	ClientIP  string
+	Method    string
+	URI       string
+	Website   string
+	Asset     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	TLS       bool
+	UserAgent string
+	Referer   string
+}
+
+// listener is the listener the request came in on
+func (e *Entry) listener() string {
+	if e.TLS {
+		return "tls"
+	}
+	return "http"
+}
+
+// Logger writes access log entries
+type Logger struct {
+	format       string
+	sampleRate   float64
+	alwaysErrors bool
+
+	out  *lumberjack.Logger
+	json zerolog.Logger
+
+	mux  sync.Mutex
+	rand *rand.Rand
+	stop chan struct{}
+}
+
+// New opens the access log, nil is returned if it's disabled
+func New() (*Logger, error) {
+	if !viper.GetBool("AccessLog.Enabled") {
+		return nil, nil
+	}
+
+	format := strings.ToLower(viper.GetString("AccessLog.Format"))
+	if format != FormatJSON && format != FormatCombined {
+		return nil, fmt.Errorf("unknown access log format %q, use json or combined", format)
+	}
+	file := viper.GetString("AccessLog.File")
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	out := &lumberjack.Logger{
+		Filename:   file,
+		MaxSize:    viper.GetInt("AccessLog.MaxSizeMB"),
+		MaxBackups: viper.GetInt("AccessLog.MaxBackups"),
+		MaxAge:     viper.GetInt("AccessLog.MaxAgeDays"),
+		Compress:   viper.GetBool("AccessLog.Compress"),
+	}
+	l := &Logger{
+		format:       format,
+		sampleRate:   viper.GetFloat64("AccessLog.SampleRate"),
+		alwaysErrors: viper.GetBool("AccessLog.AlwaysLogErrors"),
+		out:          out,
+		json:         zerolog.New(out),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:         make(chan struct{}),
+	}
+
+	if interval := viper.GetDuration("AccessLog.RotateInterval"); interval > 0 {
+		go l.rotateEvery(interval)
+	}
+	return l, nil
+}
+
+func (l *Logger) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.out.Rotate()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// sampled decides if an entry is written, errors can always be written
+func (l *Logger) sampled(e *Entry) bool {
+	if l.sampleRate >= 1 || (l.alwaysErrors && e.Status >= 400) {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.rand.Float64() < l.sampleRate
+}
+
+// Log writes an entry, unless it's sampled out
+func (l *Logger) Log(e *Entry) {
+	if l == nil || !l.sampled(e) {
+		return
+	}
+
+	if l.format == FormatCombined {
+		l.out.Write([]byte(combined(e)))
+		return
+	}
+	l.json.Log().
+		Time("time", e.Time).
+		Str("client_ip", e.ClientIP).
+		Str("method", e.Method).
+		Str("uri", e.URI).
+		Str("website", e.Website).
+		Str("asset", e.Asset).
+		Int("status", e.Status).
+		Int64("bytes", e.Bytes).
+		Float64("duration", e.Duration.Seconds()).
+		Str("listener", e.listener()).
+		Str("user_agent", e.UserAgent).
+		Str("referer", e.Referer).
+		Msg("")
+}
+
+// combined formats an entry in the Combined Log Format, with the duration in
+// seconds and the listener added at the end
+func combined(e *Entry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %.6f %s\n",
+		e.ClientIP,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(e.Method+" "+e.URI+" HTTP/1.1"),
+		e.Status,
+		bytes,
+		quote(e.Referer),
+		quote(e.UserAgent),
+		e.Duration.Seconds(),
+		e.listener(),
+	)
+}
+
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// Close stops rotating and closes the log file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	return l.out.Close()
+}
@@ -0,0 +1,122 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCombined(t *testing.T) {
+	at := time.Date(2019, 2, 1, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name  string
+		entry Entry
+		want  string
+	}{
+		{
+			"full entry",
+			Entry{Time: at, ClientIP: "1.2.3.4", Method: "GET", URI: "/content?website=site&asset=a", Status: 200, Bytes: 512, Duration: 1500 * time.Microsecond, TLS: true, UserAgent: "curl/7.0", Referer: "https://example.com/"},
+			`1.2.3.4 - - [01/Feb/2019:15:04:05 +0000] "GET /content?website=site&asset=a HTTP/1.1" 200 512 "https://example.com/" "curl/7.0" 0.001500 tls` + "\n",
+		},
+		{
+			"no body, referer or user agent",
+			Entry{Time: at, ClientIP: "1.2.3.4", Method: "GET", URI: "/bulk", Status: 404},
+			`1.2.3.4 - - [01/Feb/2019:15:04:05 +0000] "GET /bulk HTTP/1.1" 404 - "-" "-" 0.000000 http` + "\n",
+		},
+		{
+			"quotes are escaped",
+			Entry{Time: at, ClientIP: "1.2.3.4", Method: "GET", URI: "/", Status: 200, UserAgent: `evil" agent`},
+			`1.2.3.4 - - [01/Feb/2019:15:04:05 +0000] "GET / HTTP/1.1" 200 - "-" "evil\" agent" 0.000000 http` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combined(&tt.entry); got != tt.want {
+				t.Errorf("combined =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampled(t *testing.T) {
+	tests := []struct {
+		name         string
+		sampleRate   float64
+		alwaysErrors bool
+		status       int
+		want         bool
+	}{
+		{"everything", 1, false, 200, true},
+		{"nothing", 0, false, 200, false},
+		{"errors always", 0, true, 500, true},
+		{"errors sampled", 0, false, 404, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Logger{sampleRate: tt.sampleRate, alwaysErrors: tt.alwaysErrors, rand: rand.New(rand.NewSource(1))}
+			if got := l.sampled(&Entry{Status: tt.status}); got != tt.want {
+				t.Errorf("sampled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLog(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{FormatJSON, false},
+		{FormatCombined, false},
+		{"xml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			defer viper.Reset()
+			file := filepath.Join(t.TempDir(), "logs", "access.log")
+			viper.Set("AccessLog.Enabled", true)
+			viper.Set("AccessLog.Format", tt.format)
+			viper.Set("AccessLog.File", file)
+			viper.Set("AccessLog.SampleRate", 1.0)
+
+			l, err := New()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			l.Log(&Entry{Time: time.Now(), ClientIP: "1.2.3.4", Method: "GET", URI: "/content", Website: "site", Status: 200})
+			l.Close()
+
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.format == FormatJSON {
+				var got map[string]interface{}
+				if err := json.Unmarshal(b, &got); err != nil || got["website"] != "site" || got["status"] != 200.0 {
+					t.Errorf("logged %s", b)
+				}
+			} else if !strings.HasPrefix(string(b), "1.2.3.4 - - [") {
+				t.Errorf("logged %s", b)
+			}
+		})
+	}
+
+	viper.Set("AccessLog.Enabled", false)
+	defer viper.Reset()
+	if l, err := New(); l != nil || err != nil {
+		t.Error("opened a disabled access log")
+	}
+	// A disabled log is nil and can still be used
+	var l *Logger
+	l.Log(&Entry{})
+	l.Close()
+}
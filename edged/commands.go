@@ -0,0 +1,88 @@
+package edged
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/gladiusio/gladius-edged/edged/config"
+	"github.com/gladiusio/gladius-edged/edged/snapshot"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Export writes the content of this node (or only some websites) to a
+// snapshot archive, usage: export [-websites a.com,b.com] -o FILE
+func Export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", "", "file to write the snapshot to")
+	websites := flags.String("websites", "", "comma separated websites to export, defaults to every website")
+	flags.Parse(args)
+
+	if *out == "" {
+		return errors.New("an output file is required (-o)")
+	}
+
+	setupCommand()
+
+	f, err := os.Create(*out + "_temp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*out + "_temp")
+
+	var toExport []string
+	if *websites != "" {
+		toExport = strings.Split(*websites, ",")
+	}
+	m, err := snapshot.Export(f, viper.GetString("ContentDirectory"), toExport)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(*out+"_temp", *out); err != nil {
+		return err
+	}
+
+	log.Info().Int("websites", len(m.Websites)).Int("assets", m.Assets()).Str("file", *out).Msg("Exported content snapshot")
+	return nil
+}
+
+// Import verifies a snapshot archive and adds its content to this node,
+// usage: import FILE
+func Import(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("a snapshot file to import is required")
+	}
+
+	setupCommand()
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := snapshot.Import(f, viper.GetString("ContentDirectory"))
+	if err != nil {
+		return err
+	}
+
+	log.Info().Int("websites", len(m.Websites)).Int("assets", m.Assets()).Msg("Imported content snapshot")
+	return nil
+}
+
+func setupCommand() {
+	message, err := config.SetupConfig()
+	setupLogger()
+	if err != nil {
+		log.Warn().Msg(message)
+	}
+}
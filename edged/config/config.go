@@ -1,11 +1,14 @@
 package config
 
 import (
+	"errors"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gladiusio/gladius-common/pkg/utils"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // SetupConfig sets up viper and adds our config options
@@ -44,6 +47,168 @@ func buildOptions(base string) {
 	ConfigOption("ContentPort", "8080")
 	ConfigOption("HTTPPort", "8081")
 
+	// TLS certificate for the content port, reloaded when the files change or
+	// on SIGHUP. The embedded certificate is only for development, every node
+	// using it shares the same private key.
+	ConfigOption("TLS.Cert", "")
+	ConfigOption("TLS.Key", "")
+	ConfigOption("TLS.CAChain", "")
+	ConfigOption("TLS.DevFallback", false)
+
+	// Certificates for our domains from an ACME CA, answering HTTP-01 challenges
+	// on the HTTP port and TLS-ALPN-01 on the content port. The CA connects to
+	// ports 80 and 443, so those have to reach ours. Without TLS.Cert as well
+	// handshakes without a server name (SNI) fail.
+	ConfigOption("ACME.Enabled", false)
+	ConfigOption("ACME.AcceptTOS", false)
+	ConfigOption("ACME.Domains", []string{})
+	ConfigOption("ACME.Email", "")
+	ConfigOption("ACME.DirectoryURL", autocert.DefaultACMEDirectory)
+	ConfigOption("ACME.CARoots", "")
+	ConfigOption("ACME.CacheDir", filepath.Join(base, "acme"))
+	ConfigOption("ACME.RenewBefore", "720h")
+
+	// Pull-through fetching of assets we don't have when they are requested
+	ConfigOption("PullThrough.Enabled", false)
+	ConfigOption("PullThrough.Timeout", "30s")
+	ConfigOption("PullThrough.NegativeCacheTTL", "1m")
+	ConfigOption("PullThrough.MaxMisses", 10000)
+	ConfigOption("PullThrough.MaxInFlight", 64)
+
+	// Content sync, the gateway notifies us of content we need over a
+	// subscription and polling is a fallback
+	ConfigOption("Sync.Subscribe", true)
+	ConfigOption("Sync.SubscribeEndpoint", "/p2p/state/content_needed/events")
+	ConfigOption("Sync.SubscribeIdleTimeout", "90s")
+	ConfigOption("Sync.PollInterval", "2s")
+	ConfigOption("Sync.FallbackPollInterval", "5m")
+	ConfigOption("Sync.DownloadTimeout", "1m")
+
+	// Bulk bootstrapping, when one peer has at least MinAssets and MinFraction
+	// of the content we need it's downloaded from it as a single archive. We
+	// serve at most MaxConcurrent archives of MaxAssets each at a time.
+	ConfigOption("Bulk.Enabled", false)
+	ConfigOption("Bulk.MinAssets", 20)
+	ConfigOption("Bulk.MinFraction", 0.5)
+	ConfigOption("Bulk.MaxAssets", 1000)
+	ConfigOption("Bulk.MaxConcurrent", 2)
+	ConfigOption("Bulk.Timeout", "10m")
+
+	// How we advertise our disk content to the network, with deltas enabled
+	// only changes are sent with a full snapshot every so often
+	ConfigOption("Advertise.Deltas", false)
+	ConfigOption("Advertise.SnapshotEvery", 50)
+	ConfigOption("Advertise.SnapshotInterval", "30m")
+	// A bloom filter of our content sent "off", "with_list" or in place of the
+	// list ("only") when the gateway supports it
+	ConfigOption("Advertise.Filter", "off")
+	ConfigOption("Advertise.FilterFalsePositiveRate", 0.01)
+	ConfigOption("Advertise.FilterMaxBytes", 1024*1024)
+
+	// Storage limits, sizes like "500MB" or "20GB" and 0 for no limit (an
+	// invalid size stops startup). Assets are evicted least recently ("lru")
+	// or least frequently ("lfu") served
+	ConfigOption("Storage.MaxBytes", "0")
+	ConfigOption("Storage.EvictionPolicy", "lru")
+	ConfigOption("Storage.EvictionCooldown", "1h")
+	ConfigOption("Storage.Quotas", []map[string]string{})
+
+	// Garbage collection of content the network no longer wants us to hold,
+	// decided by the gateway or a desired state manifest file if set
+	ConfigOption("GC.Enabled", false)
+	ConfigOption("GC.Interval", "1h")
+	ConfigOption("GC.GracePeriod", "24h")
+	ConfigOption("GC.DryRun", false)
+	ConfigOption("GC.Manifest", "")
+	ConfigOption("GC.Endpoint", "/p2p/state/content_wanted")
+
+	// Index of the content directory so startup doesn't read and hash every
+	// asset, with lazy loading assets are only read when first requested
+	ConfigOption("Index.File", filepath.Join(base, "index.db"))
+	ConfigOption("Index.LazyLoad", true)
+	ConfigOption("Index.FlushInterval", "1m")
+
+	// Access stats of what we serve are kept in memory and saved to the index
+	ConfigOption("Stats.FlushInterval", "1m")
+
+	// Hourly and daily traffic history, hourly points are downsampled into
+	// daily ones and each is kept for its retention
+	ConfigOption("TimeSeries.Enabled", true)
+	ConfigOption("TimeSeries.RollupInterval", "1m")
+	ConfigOption("TimeSeries.HourlyRetention", "2160h")
+	ConfigOption("TimeSeries.DailyRetention", "8760h")
+
+	// Pinned websites and assets (<website>/<asset>) are always kept, more can
+	// be pinned at runtime and are saved in the pins file
+	ConfigOption("Pins.Websites", []string{})
+	ConfigOption("Pins.Assets", []string{})
+	ConfigOption("Pins.File", filepath.Join(base, "pins.json"))
+
+	// Tombstones of removed content are kept for the TTL so we don't download
+	// it again from peers that still have it
+	ConfigOption("Tombstones.TTL", "168h")
+	ConfigOption("Tombstones.File", filepath.Join(base, "tombstones.json"))
+
+	// Parent edge node to fetch content from before asking peers, the address
+	// is the host:port of the parent's HTTP port
+	ConfigOption("ParentEdge.Address", "")
+	ConfigOption("ParentEdge.Protocol", "http")
+
+	// Authoritative origin servers for websites, used when no peer has an asset
+	ConfigOption("Origins", []map[string]string{})
+
+	// Admin listener for status, management and debug (pprof) endpoints, a
+	// host:port or a unix socket like unix:/path/to/admin.sock
+	ConfigOption("Admin.Enabled", true)
+	ConfigOption("Admin.Address", "127.0.0.1:8082")
+	// Callers authenticate with a bearer token or a client certificate (with
+	// TLS and a client CA), each with a "read" or "write" scope. Callers with
+	// neither get the anonymous scope ("none", "read" or "write").
+	ConfigOption("Admin.AnonymousScope", "none")
+	// Host names besides the admin address, localhost and IP addresses that
+	// requests may use, anything else is refused to stop DNS rebinding
+	ConfigOption("Admin.AllowedHosts", []string{})
+	ConfigOption("Admin.Tokens", []map[string]string{})
+	ConfigOption("Admin.ClientCerts", []map[string]string{})
+	ConfigOption("Admin.TLS.Enabled", false)
+	ConfigOption("Admin.TLS.Cert", "")
+	ConfigOption("Admin.TLS.Key", "")
+	ConfigOption("Admin.TLS.ClientCA", "")
+	// Every call that changes the node is logged here with who made it
+	ConfigOption("Admin.AuditLog", filepath.Join(base, "logs", "admin-audit.log"))
+
+	// Readiness (/readyz on the content and admin ports) fails when the last heartbeat
+	// is older than MaxHeartbeatAge or the content disk has less free space
+	// than MinFreeDisk or MinFreePercent (0 to turn either off)
+	ConfigOption("Health.MaxHeartbeatAge", "30s")
+	ConfigOption("Health.MinFreeDisk", "1GB")
+	ConfigOption("Health.MinFreePercent", 5.0)
+
+	// Prometheus metrics, served at /metrics on their own address
+	ConfigOption("Metrics.Enabled", false)
+	ConfigOption("Metrics.Address", "127.0.0.1:9101")
+
+	// Access log of the content server, rotated by size and every interval
+	// ("0" for size only) and sampled at the sample rate, errors can always be logged
+	ConfigOption("AccessLog.Enabled", false)
+	ConfigOption("AccessLog.Format", "json")
+	ConfigOption("AccessLog.File", filepath.Join(base, "logs", "access.log"))
+	ConfigOption("AccessLog.MaxSizeMB", 100)
+	ConfigOption("AccessLog.MaxBackups", 10)
+	ConfigOption("AccessLog.MaxAgeDays", 30)
+	ConfigOption("AccessLog.Compress", true)
+	ConfigOption("AccessLog.RotateInterval", "24h")
+	ConfigOption("AccessLog.SampleRate", 1.0)
+	ConfigOption("AccessLog.AlwaysLogErrors", true)
+
+	// OpenTelemetry tracing, exported over OTLP/HTTP to the endpoint (host:port)
+	ConfigOption("Tracing.Enabled", false)
+	ConfigOption("Tracing.Endpoint", "localhost:4318")
+	ConfigOption("Tracing.URLPath", "")
+	ConfigOption("Tracing.Insecure", true)
+	ConfigOption("Tracing.ServiceName", "gladius-edged")
+	ConfigOption("Tracing.SampleRatio", 1.0)
+
 	// P2P options
 	ConfigOption("P2PSeedNodeAddress", "165.227.16.209")
 	ConfigOption("P2PSeedNodePort", "7947")
@@ -69,3 +234,47 @@ func ConfigOption(key string, defaultValue interface{}) string {
 
 	return key
 }
+
+// GetBytes returns the size in bytes of a config option like "512MB" or "10GB"
+func GetBytes(key string) int64 {
+	size, err := ParseBytes(viper.GetString(key))
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// CheckBytes makes sure each of the config options is a valid size
+func CheckBytes(keys ...string) error {
+	for _, key := range keys {
+		if _, err := ParseBytes(viper.GetString(key)); err != nil {
+			return errors.New(key + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// ParseBytes parses a size with an optional KB, MB, GB or TB suffix (powers
+// of 1024), a plain number is in bytes
+func ParseBytes(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(size, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			size = strings.TrimSpace(strings.TrimSuffix(size, suffix))
+			break
+		}
+	}
+	size = strings.TrimSuffix(size, "B")
+
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size: " + size)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"1KB", 1024, false},
+		{"1.5 MB", 1536 * 1024, false},
+		{"20GB", 20 << 30, false},
+		{"2tb", 2 << 40, false},
+		{" 10 gb ", 10 << 30, false},
+		{"10G", 0, true},
+		{"10 GiB", 0, true},
+		{"ten GB", 0, true},
+		{"-1GB", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := ParseBytes(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBytes(%q) err = %v, wantErr %v", tt.size, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBytes(%q) = %d, want %d", tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantErr bool
+	}{
+		{"valid sizes", map[string]string{"Storage.MaxBytes": "20GB", "Health.MinFreeDisk": "1GB"}, false},
+		{"unset is no limit", map[string]string{}, false},
+		{"typo", map[string]string{"Storage.MaxBytes": "10G", "Health.MinFreeDisk": "1GB"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			for k, v := range tt.values {
+				viper.Set(k, v)
+			}
+			if err := CheckBytes("Storage.MaxBytes", "Health.MinFreeDisk"); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
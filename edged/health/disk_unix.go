@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "syscall"
+
+// diskSpace returns the bytes available to us and the size of the disk
+// holding path
+func diskSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/config"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+)
+
+// HealthzHandler says the process is alive, if it can answer it is
+func HealthzHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("application/json")
+	ctx.WriteString(`{"alive":true}`)
+}
+
+// ReadyzHandler returns a handler that runs the readiness checks, anything
+// failing is a 503
+func ReadyzHandler(s *state.State, p2p *handler.P2PHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		report := Readiness(s, p2p)
+		if !report.Ready {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		}
+		b, _ := json.Marshal(report)
+		ctx.SetContentType("application/json")
+		ctx.Write(b)
+	}
+}
+
+// Readiness runs every readiness check of the edged
+func Readiness(s *state.State, p2p *handler.P2PHandler) *Report {
+	return Run(
+		Checker{Name: "running", Check: func() (string, error) {
+			if !s.Running() {
+				return "", errors.New("shutting down")
+			}
+			return "", nil
+		}},
+		Checker{Name: "index", Check: func() (string, error) {
+			return "", s.IndexReady()
+		}},
+		Checker{Name: "joined", Check: func() (string, error) {
+			return checkJoined(p2p)
+		}},
+		Checker{Name: "gateway", Check: checkGateway},
+		Checker{Name: "heartbeat", Check: checkHeartbeat},
+		Checker{Name: "disk", Check: func() (string, error) {
+			return Disk(viper.GetString("ContentDirectory"), config.GetBytes("Health.MinFreeDisk"), viper.GetFloat64("Health.MinFreePercent"))
+		}},
+	)
+}
+
+// checkJoined fails until we have joined the p2p network and finished
+// connecting, and again after we leave it. Nodes that join by hand skip it.
+func checkJoined(p2p *handler.P2PHandler) (string, error) {
+	if viper.GetBool("DisableAutoJoin") {
+		return "auto join disabled", nil
+	}
+	if !p2p.JoinReleased() || !p2p.Joined() {
+		return "", errors.New("haven't joined the p2p network")
+	}
+	return "", nil
+}
+
+// checkGateway fails if our latest call to the network gateway failed
+func checkGateway() (string, error) {
+	g := metrics.Gateway()
+	switch {
+	case g.LastSuccess.IsZero() && g.LastError.IsZero():
+		return "", errors.New("haven't called the network gateway yet")
+	case g.LastError.After(g.LastSuccess):
+		return "", errors.New("network gateway unreachable: " + g.Error)
+	default:
+		return "last success " + time.Since(g.LastSuccess).Round(time.Second).String() + " ago", nil
+	}
+}
+
+// checkHeartbeat fails if we haven't managed to send a heartbeat recently
+func checkHeartbeat() (string, error) {
+	if viper.GetBool("DisableHeartbeat") {
+		return "heartbeat disabled", nil
+	}
+	last := metrics.LastHeartbeat()
+	if last.IsZero() {
+		return "", errors.New("no heartbeat sent yet")
+	}
+	age := time.Since(last)
+	if age > viper.GetDuration("Health.MaxHeartbeatAge") {
+		return "", errors.New("last heartbeat was " + age.Round(time.Second).String() + " ago")
+	}
+	return "last heartbeat " + age.Round(time.Second).String() + " ago", nil
+}
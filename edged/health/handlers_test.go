@@ -0,0 +1,89 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/spf13/viper"
+)
+
+func TestCheckHeartbeat(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("Health.MaxHeartbeatAge", time.Minute)
+
+	// Heartbeats are process wide, so this runs in the order they happen
+	viper.Set("DisableHeartbeat", true)
+	if _, err := checkHeartbeat(); err != nil {
+		t.Errorf("disabled heartbeat failed the check: %v", err)
+	}
+	viper.Set("DisableHeartbeat", false)
+	if metrics.LastHeartbeat().IsZero() {
+		if _, err := checkHeartbeat(); err == nil {
+			t.Error("ready without a heartbeat")
+		}
+	}
+	metrics.Heartbeat()
+	if _, err := checkHeartbeat(); err != nil {
+		t.Errorf("fresh heartbeat failed the check: %v", err)
+	}
+	viper.Set("Health.MaxHeartbeatAge", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := checkHeartbeat(); err == nil {
+		t.Error("stale heartbeat passed the check")
+	}
+}
+
+func TestCheckGateway(t *testing.T) {
+	metrics.ObserveGateway("/p2p/state/content_diff", time.Now(), nil)
+	if _, err := checkGateway(); err != nil {
+		t.Errorf("gateway that answered failed the check: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	metrics.ObserveGateway("/p2p/state/content_diff", time.Now(), errors.New("connection refused"))
+	if _, err := checkGateway(); err == nil {
+		t.Error("unreachable gateway passed the check")
+	}
+}
+
+func TestCheckJoined(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer gateway.Close()
+
+	tests := []struct {
+		name            string
+		disableAutoJoin bool
+		setup           func(p2p *handler.P2PHandler) error
+		wantErr         bool
+	}{
+		{"never joined", false, func(*handler.P2PHandler) error { return nil }, true},
+		{"joined but still connecting", false, func(p2p *handler.P2PHandler) error { return p2p.Join() }, true},
+		{"left", false, func(p2p *handler.P2PHandler) error {
+			if err := p2p.Join(); err != nil {
+				return err
+			}
+			return p2p.Leave()
+		}, true},
+		{"auto join disabled", true, func(*handler.P2PHandler) error { return nil }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set("DisableAutoJoin", tt.disableAutoJoin)
+			p2p := handler.New(gateway.URL, "", "", "", "")
+			if err := tt.setup(p2p); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := checkJoined(p2p); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package health runs the readiness checks of the edged, each check reports
+// its own result so an orchestrator (or operator) can see what's wrong
+package health
+
+import (
+	"fmt"
+)
+
+// Check is the result of one readiness check
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Report is the result of every readiness check, ready only if all passed
+type Report struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// Checker is a named check, a nil error passes and the message says why
+type Checker struct {
+	Name  string
+	Check func() (string, error)
+}
+
+// Run runs every check in order
+func Run(checkers ...Checker) *Report {
+	r := &Report{Ready: true, Checks: make([]Check, 0, len(checkers))}
+	for _, c := range checkers {
+		message, err := c.Check()
+		check := Check{Name: c.Name, OK: err == nil, Message: message}
+		if err != nil {
+			check.Message = err.Error()
+			r.Ready = false
+		}
+		r.Checks = append(r.Checks, check)
+	}
+	return r
+}
+
+// Disk fails when the disk holding path has less than minFree bytes or
+// minPercent percent free, either limit is off at 0
+func Disk(path string, minFree int64, minPercent float64) (string, error) {
+	free, total, err := diskSpace(path)
+	if err != nil {
+		return "", err
+	}
+
+	percent := 100.0
+	if total > 0 {
+		percent = float64(free) / float64(total) * 100
+	}
+	message := fmt.Sprintf("%d of %d bytes free (%.1f%%)", free, total, percent)
+	if (minFree > 0 && free < uint64(minFree)) || (minPercent > 0 && percent < minPercent) {
+		return "", fmt.Errorf("disk is nearly full, %s", message)
+	}
+	return message, nil
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	pass := Checker{Name: "pass", Check: func() (string, error) { return "fine", nil }}
+	fail := Checker{Name: "fail", Check: func() (string, error) { return "ignored", errors.New("broken") }}
+
+	tests := []struct {
+		name      string
+		checkers  []Checker
+		wantReady bool
+		wantMsgs  []string
+	}{
+		{"no checks", nil, true, nil},
+		{"all pass", []Checker{pass, pass}, true, []string{"fine", "fine"}},
+		{"one fails", []Checker{pass, fail, pass}, false, []string{"fine", "broken", "fine"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Run(tt.checkers...)
+			if r.Ready != tt.wantReady || len(r.Checks) != len(tt.wantMsgs) {
+				t.Fatalf("report = %+v", r)
+			}
+			for i, c := range r.Checks {
+				if c.Message != tt.wantMsgs[i] || c.OK != (c.Name == "pass") {
+					t.Errorf("check %d = %+v", i, c)
+				}
+			}
+		})
+	}
+}
+
+func TestDisk(t *testing.T) {
+	tests := []struct {
+		name       string
+		minFree    int64
+		minPercent float64
+		wantErr    bool
+	}{
+		{"no limits", 0, 0, false},
+		{"enough free bytes", 1, 0, false},
+		{"not enough free bytes", math.MaxInt64, 0, true},
+		{"not enough free percent", 0, 101, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Disk(os.TempDir(), tt.minFree, tt.minPercent); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Disk("/does/not/exist", 0, 0); err == nil {
+		t.Error("no error for a path that doesn't exist")
+	}
+}
@@ -0,0 +1,221 @@
+// Package metrics exposes what the edged is doing to Prometheus
+package metrics
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const namespace = "edged"
+
+var (
+	// Requests counts requests to the content server
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests to the content server by route, status and website.",
+	}, []string{"route", "status", "website"})
+
+	// RequestDuration is how long the content server takes to respond
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to respond to requests to the content server by route, status and website.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "status", "website"})
+
+	// BytesServed counts the asset bytes we served
+	BytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_served_total",
+		Help:      "Asset bytes served by website.",
+	}, []string{"website"})
+
+	// CacheRequests counts asset requests we could serve ourselves (hit) and
+	// the ones we couldn't (miss)
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Asset requests by website and whether we had the asset (hit) or not (miss).",
+	}, []string{"website", "result"})
+
+	// SyncQueueDepth is how much content the current sync round has left
+	SyncQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_queue_depth",
+		Help:      "Assets left to download in the current sync round.",
+	})
+
+	// Downloads counts downloads by where they came from
+	Downloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Asset downloads by source (parent, peer or origin), peer host and result.",
+	}, []string{"source", "peer", "result"})
+
+	// HashMismatches counts assets that didn't match their hash
+	HashMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hash_mismatches_total",
+		Help:      "Assets that didn't match their hash, downloaded or on disk.",
+	})
+
+	// GatewayRequests counts calls to the network gateway
+	GatewayRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gateway_requests_total",
+		Help:      "Calls to the network gateway by endpoint and result.",
+	}, []string{"endpoint", "result"})
+
+	// GatewayDuration is how long calls to the network gateway take
+	GatewayDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gateway_request_duration_seconds",
+		Help:      "Time taken by calls to the network gateway by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	// Joined is 1 while we are joined to the p2p network
+	Joined = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "joined",
+		Help:      "1 if the node has joined the p2p network.",
+	})
+
+	lastHeartbeat int64
+	_             = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_age_seconds",
+		Help:      "Seconds since the last successful heartbeat, -1 if there hasn't been one.",
+	}, func() float64 {
+		last := atomic.LoadInt64(&lastHeartbeat)
+		if last == 0 {
+			return -1
+		}
+		return time.Since(time.Unix(0, last)).Seconds()
+	})
+)
+
+// Heartbeat records a successful heartbeat
+func Heartbeat() {
+	atomic.StoreInt64(&lastHeartbeat, time.Now().UnixNano())
+}
+
+// LastHeartbeat returns when the last successful heartbeat was, zero if there
+// hasn't been one
+func LastHeartbeat() time.Time {
+	last := atomic.LoadInt64(&lastHeartbeat)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// GatewayState is how our latest calls to the network gateway went
+type GatewayState struct {
+	LastSuccess time.Time
+	LastError   time.Time
+	Error       string
+}
+
+var (
+	gatewayMux   sync.Mutex
+	gatewayState GatewayState
+)
+
+// Gateway returns how our latest calls to the network gateway went
+func Gateway() GatewayState {
+	gatewayMux.Lock()
+	defer gatewayMux.Unlock()
+	return gatewayState
+}
+
+// Result is the result label for an error
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Peer is the peer label of a url, its host and port
+func Peer(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// ObserveGateway records a call to the network gateway
+func ObserveGateway(endpoint string, start time.Time, err error) {
+	GatewayDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	GatewayRequests.WithLabelValues(endpoint, Result(err)).Inc()
+
+	gatewayMux.Lock()
+	defer gatewayMux.Unlock()
+	if err != nil {
+		gatewayState.LastError = time.Now()
+		gatewayState.Error = err.Error()
+	} else {
+		gatewayState.LastSuccess = time.Now()
+	}
+}
+
+// diskUsage reports the bytes used by each website when scraped
+type diskUsage struct {
+	desc  *prometheus.Desc
+	usage func() map[string]int64
+}
+
+func (d *diskUsage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+func (d *diskUsage) Collect(ch chan<- prometheus.Metric) {
+	for website, bytes := range d.usage() {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, float64(bytes), website)
+	}
+}
+
+// RegisterDiskUsage reports the disk usage of each website from usage
+func RegisterDiskUsage(usage func() map[string]int64) {
+	prometheus.MustRegister(&diskUsage{
+		desc:  prometheus.NewDesc(namespace+"_disk_usage_bytes", "Bytes on disk by website.", []string{"website"}, nil),
+		usage: usage,
+	})
+}
+
+// Serve serves /metrics on the address
+func Serve(address string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	server := fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/metrics":
+			metricsHandler(ctx)
+		default:
+			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
+		}
+	}}
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			log.Warn().Err(err).Msg("Metrics server stopped")
+		}
+	}()
+	return ln, nil
+}
@@ -1,14 +1,18 @@
 package edged
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"strings"
 
 	"github.com/gladiusio/gladius-edged/edged/config"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
 	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/gladiusio/gladius-edged/edged/server/adminserver"
 	"github.com/gladiusio/gladius-edged/edged/server/contserver"
 	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -25,6 +29,18 @@ func Run() {
 		log.Warn().Msg(message)
 	}
 
+	// Don't start with a limit we can't read, it would mean no limit at all
+	if err := state.ValidateConfig(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid config")
+	}
+
+	// Export traces if enabled
+	shutdownTracing, err := tracing.Setup()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up tracing")
+	}
+	defer shutdownTracing(context.Background())
+
 	log.Info().Msg("Starting content server on port: " + viper.GetString("ContentPort"))
 
 	// Create a p2p handler
@@ -40,8 +56,30 @@ func Run() {
 	// Create new thread safe state of the networkd
 	s := state.New(p2pHandler)
 
+	// Expose our metrics to Prometheus
+	if viper.GetBool("Metrics.Enabled") {
+		metrics.RegisterDiskUsage(s.DiskUsage)
+		// Serving content matters more than metrics, so keep running without them
+		if _, err := metrics.Serve(viper.GetString("Metrics.Address")); err != nil {
+			log.Warn().Err(err).Msg("Error starting metrics server, running without metrics")
+		} else {
+			log.Info().Msg("Serving metrics on " + viper.GetString("Metrics.Address"))
+		}
+	}
+
+	// Serve status, management and debug endpoints away from the content ports
+	if viper.GetBool("Admin.Enabled") {
+		as := adminserver.New(s, p2pHandler, viper.GetString("Admin.Address"))
+		if err := as.Start(); err != nil {
+			log.Warn().Err(err).Msg("Error starting admin server, running without admin endpoints")
+		} else {
+			defer as.Stop()
+			log.Info().Msg("Serving admin endpoints on " + viper.GetString("Admin.Address"))
+		}
+	}
+
 	// Create a content server
-	cs := contserver.New(s, viper.GetString("ContentPort"), viper.GetString("HTTPPort"))
+	cs := contserver.New(s, p2pHandler, viper.GetString("ContentPort"), viper.GetString("HTTPPort"))
 	cs.Start()
 	defer cs.Stop()
 
@@ -52,6 +90,8 @@ func Run() {
 
 	<-c
 
+	// Stop reporting ready while we leave the network
+	s.Stop()
 	p2pHandler.LeaveIfJoined()
 }
 
@@ -2,14 +2,18 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/buger/jsonparser"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
 	ipify "github.com/rdegges/go-ipify"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -39,22 +43,22 @@ type P2PHandler struct {
 	controldBase string
 	connected    bool
 	ourIP        string
+	lastIPUpdate time.Time
 	joinChan     chan struct{}
+	left         bool
+	mux          sync.Mutex
 }
 
 // Connect connects to the p2p newtwork and starts the heartbeat once connected.
 func (p2p *P2PHandler) Connect() {
 	// Join the p2p network and handle any failures
 	if !viper.GetBool("DisableAutoJoin") {
-		joinString := `{"ip":"` + p2p.joinIP + ":" + p2p.joinPort + `"}`
-		resp, err := p2p.post("/network/join", joinString)
-		if success, _ := getSuccess(resp, err); !success {
+		if err := p2p.Join(); err != nil {
 			log.Warn().Err(err).Msg("Error joining p2p network, trying again in 10 seconds")
 			time.Sleep(10 * time.Second)
 			go p2p.Connect()
 			return
 		}
-		p2p.joined = true
 	}
 
 	// Give the p2p network a few seconds to connect, then say we're ready
@@ -72,10 +76,100 @@ func (p2p *P2PHandler) BlockUntilJoined() {
 	<-p2p.joinChan
 }
 
+// JoinReleased returns if BlockUntilJoined has stopped blocking
+func (p2p *P2PHandler) JoinReleased() bool {
+	select {
+	case <-p2p.joinChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Join asks the network gateway to join the p2p network through the seed node
+func (p2p *P2PHandler) Join() error {
+	joinString := `{"ip":"` + p2p.joinIP + ":" + p2p.joinPort + `"}`
+	resp, err := p2p.post(context.Background(), "/network/join", joinString)
+	if success, _ := getSuccess(resp, err); !success {
+		if err == nil {
+			err = errors.New("network gateway couldn't join the p2p network")
+		}
+		return err
+	}
+
+	p2p.mux.Lock()
+	p2p.joined = true
+	p2p.left = false
+	p2p.mux.Unlock()
+	metrics.Joined.Set(1)
+	return nil
+}
+
+// Leave asks the network gateway to leave the p2p network, heartbeats stop
+// until we join again
+func (p2p *P2PHandler) Leave() error {
+	resp, err := p2p.post(context.Background(), "/network/leave", "")
+	if success, _ := getSuccess(resp, err); !success {
+		if err == nil {
+			err = errors.New("network gateway couldn't leave the p2p network")
+		}
+		return err
+	}
+
+	p2p.mux.Lock()
+	p2p.joined = false
+	p2p.left = true
+	p2p.mux.Unlock()
+	metrics.Joined.Set(0)
+	return nil
+}
+
+// Joined returns if we have joined the p2p network
+func (p2p *P2PHandler) Joined() bool {
+	p2p.mux.Lock()
+	defer p2p.mux.Unlock()
+	return p2p.joined
+}
+
+func (p2p *P2PHandler) currentIP() string {
+	p2p.mux.Lock()
+	defer p2p.mux.Unlock()
+	return p2p.ourIP
+}
+
+// NetworkInfo is how this node appears to the p2p network
+type NetworkInfo struct {
+	Joined       bool
+	IP           string
+	ContentPort  string
+	HTTPPort     string
+	LastIPUpdate time.Time
+}
+
+// Info returns how this node appears to the p2p network
+func (p2p *P2PHandler) Info() NetworkInfo {
+	p2p.mux.Lock()
+	defer p2p.mux.Unlock()
+	return NetworkInfo{
+		Joined:       p2p.joined,
+		IP:           p2p.ourIP,
+		ContentPort:  p2p.contentPort,
+		HTTPPort:     p2p.httpPort,
+		LastIPUpdate: p2p.lastIPUpdate,
+	}
+}
+
+// Left returns if we were told to leave the network and haven't joined again
+func (p2p *P2PHandler) Left() bool {
+	p2p.mux.Lock()
+	defer p2p.mux.Unlock()
+	return p2p.left
+}
+
 // LeaveIfJoined will call the leave endpoint if we have joined
 func (p2p *P2PHandler) LeaveIfJoined() {
-	if p2p.joined {
-		p2p.post("/network/leave", "")
+	if p2p.Joined() {
+		p2p.Leave()
 	}
 }
 
@@ -126,9 +220,27 @@ func getSuccess(resp *http.Response, err error) (bool, []byte) {
 	return true, body
 }
 
-func (p2p *P2PHandler) post(endpoint, message string) (*http.Response, error) {
+func (p2p *P2PHandler) post(ctx context.Context, endpoint, message string) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "gateway /p2p"+endpoint)
 	byteMessage := []byte(message)
-	return http.Post(p2p.controldBase+endpoint, "application/json", bytes.NewBuffer(byteMessage))
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p2p.controldBase+endpoint, bytes.NewBuffer(byteMessage))
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	result := err
+	if err == nil && resp.StatusCode >= 400 {
+		result = errors.New("unexpected status: " + resp.Status)
+	}
+	metrics.ObserveGateway("/p2p"+endpoint, start, result)
+	tracing.End(span, result)
+	return resp, err
 }
 
 func (p2p *P2PHandler) startHearbeat() {
@@ -136,11 +248,17 @@ func (p2p *P2PHandler) startHearbeat() {
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
+			// We were told to leave, so don't tell the network we're here
+			if p2p.Left() {
+				continue
+			}
 			// Update the hearbeat with the current timestamp (in base 10)
 			if !viper.GetBool("DisableHeartbeat") {
 				err := p2p.UpdateField("heartbeat", strconv.FormatInt(time.Now().Unix(), 10))
 				if err != nil {
 					log.Warn().Err(err).Msg("Error posting heartbeat")
+				} else {
+					metrics.Heartbeat()
 				}
 			}
 			// If we have detection on, tell the network our IP and handle any failures
@@ -157,7 +275,7 @@ func (p2p *P2PHandler) startHearbeat() {
 					myIP = viper.GetString("OverrideIP")
 				}
 				// If the IP changed since last time, inform the network
-				if myIP != p2p.ourIP && myIP != "" {
+				if myIP != p2p.currentIP() && myIP != "" {
 					success, err := p2p.postIP()
 					if err != nil {
 						log.Error().Str("detected_ip", myIP).Err(err).Msg("Error updating this node's public IP in network state")
@@ -166,7 +284,10 @@ func (p2p *P2PHandler) startHearbeat() {
 						log.Warn().Str("detected_ip", myIP).Err(err).Msg("Error updating this node's public IP in network state")
 					} else {
 						// If successfull, update the local state's IP so we can detect changes
+						p2p.mux.Lock()
 						p2p.ourIP = myIP
+						p2p.lastIPUpdate = time.Now()
+						p2p.mux.Unlock()
 					}
 				}
 			}
@@ -180,26 +301,17 @@ func (p2p *P2PHandler) UpdateFields(toUpdate map[string]string) error {
 		return errors.New("Input fields can't be marshalled")
 	}
 	updateString := `{"message": {"node": ` + string(fields) + `}}`
-	resp, err := p2p.post("/message/sign", updateString)
-	success, body := getSuccess(resp, err)
-	if !success {
-		return errors.New("Couldn't sign message with contorld, wallet could be locked")
-	}
+	return p2p.signAndPush(updateString)
+}
 
-	// Get the signed message
-	signedMessageBytes, _, _, err := jsonparser.Get(body, "response")
+// UpdateFieldsJSON updates the node fields with values of any JSON type
+func (p2p *P2PHandler) UpdateFieldsJSON(toUpdate map[string]interface{}) error {
+	fields, err := json.Marshal(toUpdate)
 	if err != nil {
-		return errors.New("Controld returned a corrupted message")
-	}
-
-	// Send the signed message to the p2p network introducing ourselves
-	resp, err = p2p.post("/state/push_message", string(signedMessageBytes))
-	success, _ = getSuccess(resp, err)
-	if !success {
-		return errors.New("Couldn't push message")
+		return errors.New("Input fields can't be marshalled")
 	}
-
-	return nil
+	updateString := `{"message": {"node": ` + string(fields) + `}}`
+	return p2p.signAndPush(updateString)
 }
 
 // UpdateField updates the specified node field with the value
@@ -230,7 +342,16 @@ func (p2p *P2PHandler) UpdateField(key string, value ...string) error {
 		return errors.New("UpdateField needs at least one value")
 	}
 
-	resp, err := p2p.post("/message/sign", updateString)
+	return p2p.signAndPush(updateString)
+}
+
+// signAndPush has the network gateway sign the message with our wallet, then
+// pushes it to the p2p network
+func (p2p *P2PHandler) signAndPush(updateString string) (err error) {
+	ctx, span := tracing.Start(context.Background(), "sign_and_push")
+	defer func() { tracing.End(span, err) }()
+
+	resp, err := p2p.post(ctx, "/message/sign", updateString)
 	success, body := getSuccess(resp, err)
 	if !success {
 		return errors.New("Couldn't sign message with network gateway, wallet could be locked")
@@ -243,7 +364,7 @@ func (p2p *P2PHandler) UpdateField(key string, value ...string) error {
 	}
 
 	// Send the signed message to the p2p network introducing ourselves
-	resp, err = p2p.post("/state/push_message", string(signedMessageBytes))
+	resp, err = p2p.post(ctx, "/state/push_message", string(signedMessageBytes))
 	success, _ = getSuccess(resp, err)
 	if !success {
 		return errors.New("Couldn't push message")
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	testExporter     = tracetest.NewInMemoryExporter()
+	testExporterOnce sync.Once
+)
+
+// newTestExporter sends spans to memory. The tracer only picks up the first
+// tracer provider that is set, so every test shares the exporter.
+func newTestExporter(t *testing.T) *tracetest.InMemoryExporter {
+	testExporterOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	testExporter.Reset()
+	return testExporter
+}
+
+func TestPostTracing(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   codes.Code
+	}{
+		{"success", http.StatusOK, codes.Unset},
+		{"gateway error", http.StatusInternalServerError, codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := newTestExporter(t)
+			var traceparent string
+			gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				traceparent = r.Header.Get("traceparent")
+				w.WriteHeader(tt.status)
+			}))
+			defer gateway.Close()
+
+			p2p := New(gateway.URL, "", "", "", "")
+			ctx, parent := otel.Tracer("test").Start(context.Background(), "sign_and_push")
+			resp, err := p2p.post(ctx, "/message/sign", "{}")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			parent.End()
+
+			spans := exporter.GetSpans()
+			if len(spans) != 2 {
+				t.Fatalf("%d spans, want the post and its parent", len(spans))
+			}
+			post := spans[0]
+			if post.Name != "gateway /p2p/message/sign" {
+				t.Errorf("span %q, want the gateway endpoint", post.Name)
+			}
+			if post.Parent.SpanID() != parent.SpanContext().SpanID() {
+				t.Error("the post isn't a child of the caller's span")
+			}
+			if post.Status.Code != tt.want {
+				t.Errorf("status = %v, want %v", post.Status.Code, tt.want)
+			}
+			if !strings.Contains(traceparent, post.SpanContext.SpanID().String()) {
+				t.Errorf("gateway got traceparent %q, want the post's span", traceparent)
+			}
+		})
+	}
+}
+
+func TestJoinLeave(t *testing.T) {
+	success := true
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/network/join" && r.URL.Path != "/network/leave" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"success": %v}`, success)
+	}))
+	defer gateway.Close()
+
+	p2p := New(gateway.URL, "127.0.0.1", "7946", "8080", "8081")
+	if err := p2p.Join(); err != nil || !p2p.Joined() {
+		t.Fatalf("join: err = %v, joined = %v", err, p2p.Joined())
+	}
+	if err := p2p.Leave(); err != nil || p2p.Joined() || !p2p.Left() {
+		t.Fatalf("leave: err = %v, joined = %v", err, p2p.Joined())
+	}
+
+	success = false
+	if err := p2p.Join(); err == nil || p2p.Joined() {
+		t.Fatalf("join the gateway refused: err = %v, joined = %v", err, p2p.Joined())
+	}
+}
@@ -0,0 +1,250 @@
+// Package adminserver serves the status, management and debug endpoints on
+// their own listener, bound to localhost or a unix socket so they aren't
+// exposed on the public content ports
+package adminserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/buildinfo"
+	"github.com/gladiusio/gladius-edged/edged/health"
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/pprofhandler"
+)
+
+// AdminServer serves the admin endpoints from the state
+type AdminServer struct {
+	running  bool
+	address  string
+	listener net.Listener
+	state    *state.State
+	p2p      *handler.P2PHandler
+	auth     *authenticator
+	audit    *auditLog
+	started  time.Time
+}
+
+// New creates a new admin server, address is a host:port or a unix socket
+// like unix:/path/to/admin.sock
+func New(state *state.State, p2p *handler.P2PHandler, address string) *AdminServer {
+	return &AdminServer{state: state, p2p: p2p, address: address}
+}
+
+// Start starts the admin server
+func (as *AdminServer) Start() error {
+	if as.running {
+		return nil
+	}
+
+	auth, err := newAuthenticator()
+	if err != nil {
+		return err
+	}
+	config, err := tlsConfig()
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(viper.GetString("Admin.AuditLog"))
+	if err != nil {
+		return err
+	}
+
+	ln, err := listen(as.address)
+	if err != nil {
+		audit.Close()
+		return err
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	as.listener = ln
+	as.auth = auth
+	as.audit = audit
+	as.started = time.Now()
+
+	server := fasthttp.Server{Handler: as.requestHandler}
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			log.Warn().Err(err).Msg("Admin server stopped")
+		}
+	}()
+
+	as.running = true
+	return nil
+}
+
+// Stop stops the admin server
+func (as *AdminServer) Stop() {
+	if as.running {
+		as.listener.Close()
+		as.audit.Close()
+		as.running = false
+	}
+}
+
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove a socket left behind by an unclean shutdown
+	path := strings.TrimPrefix(address, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only our user (and group) can connect. Keep the socket in a directory
+	// only we can enter to close the gap before this.
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// requestHandler checks the request is for us and the caller may make it, and
+// audits anything that changes the node, denied attempts included. Health
+// checks are open.
+func (as *AdminServer) requestHandler(ctx *fasthttp.RequestCtx) {
+	// Orchestrators probe health without credentials
+	switch string(ctx.Path()) {
+	case "/healthz":
+		health.HealthzHandler(ctx)
+		return
+	case "/readyz":
+		health.ReadyzHandler(as.state, as.p2p)(ctx)
+		return
+	}
+
+	if !validHost(string(ctx.Host()), as.address) {
+		writeError(ctx, fasthttp.StatusForbidden, errors.New("unknown host "+string(ctx.Host())))
+		if mutating(ctx) {
+			as.audit.record(ctx, &caller{identity: "unauthenticated"})
+		}
+		return
+	}
+
+	c, ok := as.auth.authorize(ctx)
+	if ok {
+		as.serve(ctx)
+	}
+	if mutating(ctx) {
+		as.audit.record(ctx, c)
+	}
+}
+
+func (as *AdminServer) serve(ctx *fasthttp.RequestCtx) {
+	s := as.state
+	path := string(ctx.Path())
+	if strings.HasPrefix(path, "/debug/pprof/") {
+		pprofhandler.PprofHandler(ctx)
+		return
+	}
+
+	switch path {
+	case "/status":
+		ctx.SetContentType("application/json")
+		fmt.Fprint(ctx, s.Info())
+	case "/version":
+		writeJSON(ctx, buildinfo.Get(), nil)
+	case "/admin/content":
+		contentHandler(ctx, s)
+	case "/admin/asset":
+		assetHandler(ctx, s)
+	case "/admin/asset/verify":
+		verifyHandler(ctx, s)
+	case "/admin/rescan":
+		if onlyPost(ctx) {
+			s.Rescan()
+			writeJSON(ctx, nil, nil)
+		}
+	case "/admin/sync":
+		syncHandler(ctx, s)
+	case "/admin/sync/pause":
+		if onlyPost(ctx) {
+			writeJSON(ctx, s.PauseSync(), nil)
+		}
+	case "/admin/sync/resume":
+		if onlyPost(ctx) {
+			writeJSON(ctx, s.ResumeSync(), nil)
+		}
+	case "/admin/network", "/admin/network/join", "/admin/network/leave":
+		networkHandler(ctx, s, as.p2p)
+	case "/admin/pins":
+		pinsHandler(ctx, s)
+	case "/admin/tombstones":
+		tombstonesHandler(ctx, s)
+	case "/stats":
+		statsHandler(ctx, s)
+	case "/stats/timeseries":
+		timeSeriesHandler(ctx, s)
+	case "/stats/reset":
+		statsResetHandler(ctx, s)
+	case "/debug/goroutines":
+		// Full stack of every goroutine, like a panic would print
+		ctx.SetContentType("text/plain; charset=utf-8")
+		pprof.Lookup("goroutine").WriteTo(ctx, 2)
+	case "/debug/runtime":
+		writeJSON(ctx, as.runtimeStats(), nil)
+	case "/debug/config":
+		writeJSON(ctx, redactSecrets(viper.AllSettings()), nil)
+	default:
+		ctx.Error("Unsupported path", fasthttp.StatusNotFound)
+	}
+}
+
+type runtimeStats struct {
+	Uptime       string     `json:"uptime"`
+	GoVersion    string     `json:"go_version"`
+	CPUs         int        `json:"cpus"`
+	Goroutines   int        `json:"goroutines"`
+	HeapAlloc    uint64     `json:"heap_alloc_bytes"`
+	HeapInuse    uint64     `json:"heap_inuse_bytes"`
+	HeapObjects  uint64     `json:"heap_objects"`
+	Sys          uint64     `json:"sys_bytes"`
+	TotalAlloc   uint64     `json:"total_alloc_bytes"`
+	NumGC        uint32     `json:"num_gc"`
+	LastGC       *time.Time `json:"last_gc,omitempty"`
+	PauseTotal   string     `json:"gc_pause_total"`
+	NextGCTarget uint64     `json:"next_gc_bytes"`
+}
+
+func (as *AdminServer) runtimeStats() *runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := &runtimeStats{
+		Uptime:       time.Since(as.started).Round(time.Second).String(),
+		GoVersion:    runtime.Version(),
+		CPUs:         runtime.NumCPU(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		NumGC:        m.NumGC,
+		PauseTotal:   time.Duration(m.PauseTotalNs).String(),
+		NextGCTarget: m.NextGC,
+	}
+	if m.LastGC > 0 {
+		lastGC := time.Unix(0, int64(m.LastGC))
+		stats.LastGC = &lastGC
+	}
+	return stats
+}
@@ -0,0 +1,84 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket file behind like an unclean shutdown would
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{"tcp", "127.0.0.1:0", false},
+		{"unix socket", "unix:" + filepath.Join(dir, "admin.sock"), false},
+		{"stale unix socket", "unix:" + stale, false},
+		{"missing directory", "unix:" + filepath.Join(dir, "missing", "admin.sock"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := listen(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer ln.Close()
+
+			if ln.Addr().Network() == "unix" {
+				fi, err := os.Stat(ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perm := fi.Mode().Perm(); perm&0007 != 0 {
+					t.Errorf("socket mode = %v, others can connect", perm)
+				}
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/version", fasthttp.StatusOK},
+		{"/debug/runtime", fasthttp.StatusOK},
+		{"/debug/config", fasthttp.StatusOK},
+		{"/debug/pprof/cmdline", fasthttp.StatusOK},
+		{"/content", fasthttp.StatusNotFound},
+	}
+	as := New(nil, nil, "127.0.0.1:0")
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tt.path)
+			as.serve(ctx)
+
+			if status := ctx.Response.StatusCode(); status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if string(ctx.Response.Header.ContentType()) == "application/json" && !json.Valid(ctx.Response.Body()) {
+				t.Errorf("invalid JSON %q", ctx.Response.Body())
+			}
+		})
+	}
+}
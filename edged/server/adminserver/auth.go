@@ -0,0 +1,312 @@
+package adminserver
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+)
+
+// scope is what a caller is allowed to do, write includes read
+type scope int
+
+const (
+	scopeNone scope = iota
+	scopeRead
+	scopeWrite
+)
+
+func parseScope(s string) (scope, error) {
+	switch strings.ToLower(s) {
+	case "none", "":
+		return scopeNone, nil
+	case "read":
+		return scopeRead, nil
+	case "write":
+		return scopeWrite, nil
+	default:
+		return scopeNone, fmt.Errorf("unknown admin scope %q, use none, read or write", s)
+	}
+}
+
+// tokenConfig is a bearer token and what it can do
+type tokenConfig struct {
+	Name  string
+	Token string
+	Scope string
+}
+
+// clientCertConfig gives the client certificate with this common name a scope
+type clientCertConfig struct {
+	Name  string
+	Scope string
+}
+
+type credential struct {
+	name  string
+	token []byte
+	scope scope
+}
+
+// caller is who made a request
+type caller struct {
+	identity string
+	scope    scope
+}
+
+// authenticator checks the bearer token or client certificate of a request,
+// callers without either get the anonymous scope
+type authenticator struct {
+	anonymous scope
+	tokens    []credential
+	certs     map[string]scope
+}
+
+func newAuthenticator() (*authenticator, error) {
+	a := &authenticator{certs: make(map[string]scope)}
+
+	var err error
+	if a.anonymous, err = parseScope(viper.GetString("Admin.AnonymousScope")); err != nil {
+		return nil, err
+	}
+
+	var tokens []tokenConfig
+	if err := viper.UnmarshalKey("Admin.Tokens", &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, errors.New("admin tokens need a name and a token")
+		}
+		sc, err := parseScope(t.Scope)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = append(a.tokens, credential{name: t.Name, token: []byte(t.Token), scope: sc})
+	}
+
+	var certs []clientCertConfig
+	if err := viper.UnmarshalKey("Admin.ClientCerts", &certs); err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		sc, err := parseScope(c.Scope)
+		if err != nil {
+			return nil, err
+		}
+		a.certs[c.Name] = sc
+	}
+	return a, nil
+}
+
+// authenticate finds out who made the request, a token that doesn't match is
+// an error rather than an anonymous call
+func (a *authenticator) authenticate(ctx *fasthttp.RequestCtx) (*caller, error) {
+	if header := string(ctx.Request.Header.Peek("Authorization")); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errors.New("only bearer tokens are supported")
+		}
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+
+		// Compare against every token so timing doesn't give away which matched
+		var found *credential
+		for i := range a.tokens {
+			if subtle.ConstantTimeCompare(a.tokens[i].token, token) == 1 {
+				found = &a.tokens[i]
+			}
+		}
+		if found == nil {
+			return nil, errors.New("invalid token")
+		}
+		return &caller{identity: "token:" + found.name, scope: found.scope}, nil
+	}
+
+	// The TLS handshake already checked the certificate against our client CA
+	if cs := ctx.TLSConnectionState(); cs != nil && len(cs.VerifiedChains) > 0 {
+		name := cs.PeerCertificates[0].Subject.CommonName
+		if sc, ok := a.certs[name]; ok {
+			return &caller{identity: "cert:" + name, scope: sc}, nil
+		}
+		return &caller{identity: "cert:" + name, scope: a.anonymous}, nil
+	}
+
+	return &caller{identity: "anonymous", scope: a.anonymous}, nil
+}
+
+// mutating requests change the node and need the write scope
+func mutating(ctx *fasthttp.RequestCtx) bool {
+	return !ctx.IsGet() && !ctx.IsHead()
+}
+
+// authorize checks the caller may make the request, writing the error
+// response if not
+func (a *authenticator) authorize(ctx *fasthttp.RequestCtx) (*caller, bool) {
+	c, err := a.authenticate(ctx)
+	if err != nil {
+		ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="gladius-edged"`)
+		writeError(ctx, fasthttp.StatusUnauthorized, err)
+		return &caller{identity: "unauthenticated"}, false
+	}
+
+	need := scopeRead
+	if mutating(ctx) {
+		need = scopeWrite
+	}
+	if c.scope >= need {
+		return c, true
+	}
+	if c.identity == "anonymous" {
+		ctx.Response.Header.Set("WWW-Authenticate", `Bearer realm="gladius-edged"`)
+		writeError(ctx, fasthttp.StatusUnauthorized, errors.New("authentication required"))
+	} else {
+		writeError(ctx, fasthttp.StatusForbidden, errors.New(c.identity+" isn't allowed to do that"))
+	}
+	return c, false
+}
+
+// validHost returns true if the Host header of a request names the admin
+// listener: its configured host, localhost, an IP address or one of
+// Admin.AllowedHosts. A web page can point its own host name at us (DNS
+// rebinding) to have a browser on the node call the admin endpoints, those
+// requests are refused.
+func validHost(host, address string) bool {
+	// Browsers can't reach a unix socket
+	if strings.HasPrefix(address, "unix:") {
+		return true
+	}
+
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+	if name == "" {
+		return false
+	}
+	if configured, _, err := net.SplitHostPort(address); err == nil && strings.EqualFold(name, configured) {
+		return true
+	}
+	if strings.EqualFold(name, "localhost") || net.ParseIP(name) != nil {
+		return true
+	}
+	for _, allowed := range viper.GetStringSlice("Admin.AllowedHosts") {
+		if strings.EqualFold(name, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig loads the admin listener's certificate and the CA client
+// certificates are verified against, nil if TLS is off
+func tlsConfig() (*tls.Config, error) {
+	if !viper.GetBool("Admin.TLS.Enabled") {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(viper.GetString("Admin.TLS.Cert"), viper.GetString("Admin.TLS.Key"))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile := viper.GetString("Admin.TLS.ClientCA"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in admin client CA file")
+		}
+		// Callers can still use a token instead of a certificate
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// auditLog records every mutating call to the admin endpoints and who made it
+type auditLog struct {
+	file *os.File
+	log  zerolog.Logger
+}
+
+func openAuditLog(file string) (*auditLog, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f, log: zerolog.New(f)}, nil
+}
+
+func (a *auditLog) record(ctx *fasthttp.RequestCtx, c *caller) {
+	if a == nil {
+		return
+	}
+	a.log.Log().
+		Time("time", time.Now()).
+		Str("identity", c.identity).
+		Str("remote_addr", ctx.RemoteAddr().String()).
+		Str("method", string(ctx.Method())).
+		Str("uri", string(ctx.RequestURI())).
+		Int("status", ctx.Response.StatusCode()).
+		Msg("")
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// redactSecrets replaces tokens in the settings so /debug/config can't leak them
+func redactSecrets(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		redacted[k] = redactValue(k, v)
+	}
+	return redacted
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	if strings.ToLower(key) == "token" {
+		return "REDACTED"
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return redactSecrets(t)
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, e := range t {
+			list[i] = redactValue("", e)
+		}
+		return list
+	case []map[string]interface{}:
+		list := make([]interface{}, len(t))
+		for i, e := range t {
+			list[i] = redactSecrets(e)
+		}
+		return list
+	default:
+		return v
+	}
+}
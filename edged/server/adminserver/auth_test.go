@@ -0,0 +1,197 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope   string
+		want    scope
+		wantErr bool
+	}{
+		{"", scopeNone, false},
+		{"none", scopeNone, false},
+		{"Read", scopeRead, false},
+		{"write", scopeWrite, false},
+		{"admin", scopeNone, true},
+	}
+	for _, tt := range tests {
+		got, err := parseScope(tt.scope)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseScope(%q) = %v, %v, want %v, wantErr %v", tt.scope, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("Admin.Tokens", []map[string]string{
+		{"name": "dashboard", "token": "read-token", "scope": "read"},
+		{"name": "ops", "token": "write-token", "scope": "write"},
+	})
+
+	tests := []struct {
+		name       string
+		anonymous  string
+		method     string
+		auth       string
+		wantOK     bool
+		wantStatus int
+		wantCaller string
+	}{
+		{"anonymous without a scope", "none", "GET", "", false, fasthttp.StatusUnauthorized, "anonymous"},
+		{"anonymous read", "read", "GET", "", true, fasthttp.StatusOK, "anonymous"},
+		{"anonymous read can't write", "read", "POST", "", false, fasthttp.StatusUnauthorized, "anonymous"},
+		{"read token", "none", "GET", "Bearer read-token", true, fasthttp.StatusOK, "token:dashboard"},
+		{"read token can't write", "none", "DELETE", "Bearer read-token", false, fasthttp.StatusForbidden, "token:dashboard"},
+		{"write token", "none", "POST", "Bearer write-token", true, fasthttp.StatusOK, "token:ops"},
+		{"invalid token isn't anonymous", "write", "GET", "Bearer wrong", false, fasthttp.StatusUnauthorized, "unauthenticated"},
+		{"basic auth", "none", "GET", "Basic dXNlcjpwYXNz", false, fasthttp.StatusUnauthorized, "unauthenticated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("Admin.AnonymousScope", tt.anonymous)
+			a, err := newAuthenticator()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.Header.SetMethod(tt.method)
+			if tt.auth != "" {
+				ctx.Request.Header.Set("Authorization", tt.auth)
+			}
+			c, ok := a.authorize(ctx)
+			if ok != tt.wantOK || ctx.Response.StatusCode() != tt.wantStatus {
+				t.Errorf("ok = %v status %d, want %v status %d", ok, ctx.Response.StatusCode(), tt.wantOK, tt.wantStatus)
+			}
+			if c.identity != tt.wantCaller {
+				t.Errorf("caller = %q, want %q", c.identity, tt.wantCaller)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		values interface{}
+	}{
+		{"unknown anonymous scope", "Admin.AnonymousScope", "admin"},
+		{"token without a name", "Admin.Tokens", []map[string]string{{"token": "t", "scope": "read"}}},
+		{"token with an unknown scope", "Admin.Tokens", []map[string]string{{"name": "n", "token": "t", "scope": "root"}}},
+		{"certificate with an unknown scope", "Admin.ClientCerts", []map[string]string{{"name": "n", "scope": "root"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set(tt.key, tt.values)
+			if _, err := newAuthenticator(); err == nil {
+				t.Error("invalid config was accepted")
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit", "admin.log")
+	audit, err := openAuditLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("DELETE")
+	ctx.Request.SetRequestURI("/admin/content?website=site")
+	ctx.SetStatusCode(fasthttp.StatusForbidden)
+	audit.record(ctx, &caller{identity: "token:dashboard"})
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatalf("audit entry %q isn't JSON: %v", b, err)
+	}
+	want := map[string]interface{}{"identity": "token:dashboard", "method": "DELETE", "uri": "/admin/content?website=site", "status": float64(403)}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+
+	// Without a file nothing is audited
+	if audit, err := openAuditLog(""); audit != nil || err != nil {
+		t.Errorf("openAuditLog(\"\") = %v, %v", audit, err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	settings := map[string]interface{}{
+		"contentport": "8080",
+		"admin": map[string]interface{}{
+			"anonymousscope": "none",
+			"tokens": []interface{}{
+				map[string]interface{}{"name": "dashboard", "token": "secret", "scope": "read"},
+			},
+		},
+		"origins": []map[string]interface{}{{"website": "site", "token": "origin-secret"}},
+	}
+	want := map[string]interface{}{
+		"contentport": "8080",
+		"admin": map[string]interface{}{
+			"anonymousscope": "none",
+			"tokens": []interface{}{
+				map[string]interface{}{"name": "dashboard", "token": "REDACTED", "scope": "read"},
+			},
+		},
+		"origins": []interface{}{map[string]interface{}{"website": "site", "token": "REDACTED"}},
+	}
+
+	if got := redactSecrets(settings); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactSecrets = %v, want %v", got, want)
+	}
+	if settings["admin"].(map[string]interface{})["tokens"].([]interface{})[0].(map[string]interface{})["token"] != "secret" {
+		t.Error("the settings themselves were changed")
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("Admin.AllowedHosts", []string{"node1.example.com"})
+
+	tests := []struct {
+		host    string
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:8082", "127.0.0.1:8082", true},
+		{"localhost:8082", "127.0.0.1:8082", true},
+		{"[::1]:8082", "[::1]:8082", true},
+		{"10.0.0.5:8082", "0.0.0.0:8082", true},
+		{"admin.internal:8082", "admin.internal:8082", true},
+		{"node1.example.com:8082", "0.0.0.0:8082", true},
+		{"evil.example.com:8082", "127.0.0.1:8082", false},
+		{"evil.example.com", "0.0.0.0:8082", false},
+		{"", "127.0.0.1:8082", false},
+		{"anything", "unix:/run/edged/admin.sock", true},
+	}
+	for _, tt := range tests {
+		if got := validHost(tt.host, tt.address); got != tt.want {
+			t.Errorf("validHost(%q, %q) = %v, want %v", tt.host, tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/valyala/fasthttp"
+)
+
+// statsResetHandler clears the access stats of a website, or all of them
+func statsResetHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	if !ctx.IsPost() {
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	s.ResetStats(string(ctx.QueryArgs().Peek("website")))
+	writeJSON(ctx, nil, nil)
+}
+
+// pinsHandler lists pins, or pins (POST) and unpins (DELETE) a website or one
+// of its assets, like /admin/pins?website=REQUESTED_SITE&asset=FILE_HASH
+func pinsHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	website := string(ctx.QueryArgs().Peek("website"))
+	asset := string(ctx.QueryArgs().Peek("asset"))
+
+	switch {
+	case ctx.IsGet():
+		writeJSON(ctx, s.Pins(), nil)
+	case ctx.IsPost():
+		writeJSON(ctx, s.Pins(), s.Pin(website, asset))
+	case ctx.IsDelete():
+		writeJSON(ctx, s.Pins(), s.Unpin(website, asset))
+	default:
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// tombstonesHandler lists tombstones, or removes a website or one of its assets
+// (POST) like /admin/tombstones?website=REQUESTED_SITE&asset=FILE_HASH&ttl=24h
+func tombstonesHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	switch {
+	case ctx.IsGet():
+		writeJSON(ctx, s.Tombstones(), nil)
+	case ctx.IsPost():
+		var ttl time.Duration
+		if t := string(ctx.QueryArgs().Peek("ttl")); t != "" {
+			var err error
+			if ttl, err = time.ParseDuration(t); err != nil {
+				writeJSON(ctx, nil, err)
+				return
+			}
+		}
+		err := s.Tombstone(string(ctx.QueryArgs().Peek("website")), string(ctx.QueryArgs().Peek("asset")), ttl)
+		writeJSON(ctx, s.Tombstones(), err)
+	default:
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// statsHandler reports what we served, like
+// /stats?website=REQUESTED_SITE&top=10&sort=bytes&window=1h
+func statsHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	q := state.StatsQuery{Website: string(ctx.QueryArgs().Peek("website")), Top: 10, SortBy: string(ctx.QueryArgs().Peek("sort"))}
+	if top := string(ctx.QueryArgs().Peek("top")); top != "" {
+		var err error
+		if q.Top, err = strconv.Atoi(top); err != nil {
+			writeJSON(ctx, nil, err)
+			return
+		}
+	}
+	if window := string(ctx.QueryArgs().Peek("window")); window != "" {
+		var err error
+		if q.Window, err = time.ParseDuration(window); err != nil {
+			writeJSON(ctx, nil, err)
+			return
+		}
+	}
+
+	stats, err := s.Stats(q)
+	writeJSON(ctx, stats, err)
+}
+
+// timeSeriesHandler serves the traffic history, like
+// /stats/timeseries?resolution=day&website=REQUESTED_SITE&since=720h, or a
+// range with from and to as RFC 3339 times
+func timeSeriesHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	args := ctx.QueryArgs()
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+
+	var err error
+	if since := string(args.Peek("since")); since != "" {
+		var d time.Duration
+		if d, err = time.ParseDuration(since); err != nil {
+			writeJSON(ctx, nil, err)
+			return
+		}
+		from = to.Add(-d)
+	}
+	if f := string(args.Peek("from")); f != "" {
+		if from, err = time.Parse(time.RFC3339, f); err != nil {
+			writeJSON(ctx, nil, err)
+			return
+		}
+	}
+	if t := string(args.Peek("to")); t != "" {
+		if to, err = time.Parse(time.RFC3339, t); err != nil {
+			writeJSON(ctx, nil, err)
+			return
+		}
+	}
+
+	points, err := s.TimeSeries(string(args.Peek("resolution")), string(args.Peek("website")), from, to)
+	writeJSON(ctx, points, err)
+}
+
+type apiResponse struct {
+	Success  bool        `json:"success"`
+	Error    string      `json:"error,omitempty"`
+	Response interface{} `json:"response"`
+}
+
+// writeJSON writes the response in the same format as the network gateway
+func writeJSON(ctx *fasthttp.RequestCtx, response interface{}, err error) {
+	r := apiResponse{Success: err == nil, Response: response}
+	if err != nil {
+		r.Error = err.Error()
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	}
+
+	b, _ := json.Marshal(r)
+	ctx.SetContentType("application/json")
+	ctx.Write(b)
+}
+
+// writeError writes an error response with the status code
+func writeError(ctx *fasthttp.RequestCtx, status int, err error) {
+	writeJSON(ctx, nil, err)
+	ctx.SetStatusCode(status)
+}
@@ -0,0 +1,101 @@
+package adminserver
+
+import (
+	"errors"
+
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/valyala/fasthttp"
+)
+
+// onlyPost rejects anything but a POST, the management actions change the node
+func onlyPost(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsPost() {
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// contentHandler lists our websites and assets with their sizes, or one
+// website like /admin/content?website=REQUESTED_SITE
+func contentHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	website := string(ctx.QueryArgs().Peek("website"))
+	listing := s.ContentListing()
+	if website == "" {
+		writeJSON(ctx, listing, nil)
+		return
+	}
+
+	for _, wl := range listing {
+		if wl.Name == website {
+			writeJSON(ctx, wl, nil)
+			return
+		}
+	}
+	writeJSON(ctx, nil, errors.New("website not found"))
+}
+
+// assetHandler deletes an asset (DELETE) like
+// /admin/asset?website=REQUESTED_SITE&asset=FILE_HASH
+func assetHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	if !ctx.IsDelete() {
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	err := s.DeleteAsset(string(ctx.QueryArgs().Peek("website")), string(ctx.QueryArgs().Peek("asset")))
+	writeJSON(ctx, nil, err)
+}
+
+// verifyHandler checks an asset against its hash (POST) like
+// /admin/asset/verify?website=REQUESTED_SITE&asset=FILE_HASH
+func verifyHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	if !onlyPost(ctx) {
+		return
+	}
+	result, err := s.VerifyAsset(string(ctx.QueryArgs().Peek("website")), string(ctx.QueryArgs().Peek("asset")))
+	writeJSON(ctx, result, err)
+}
+
+// syncHandler reports if sync is paused, or runs a sync round now (POST)
+func syncHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	switch {
+	case ctx.IsGet():
+		writeJSON(ctx, s.SyncStatus(), nil)
+	case ctx.IsPost():
+		writeJSON(ctx, s.SyncStatus(), s.SyncNow())
+	default:
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+type networkStatus struct {
+	Joined bool `json:"joined"`
+}
+
+// networkHandler joins or leaves the p2p network (POST) with
+// /admin/network/join and /admin/network/leave, or reports if we've joined
+func networkHandler(ctx *fasthttp.RequestCtx, s *state.State, p2p *handler.P2PHandler) {
+	var err error
+	switch string(ctx.Path()) {
+	case "/admin/network":
+		if !ctx.IsGet() {
+			ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+	case "/admin/network/join":
+		if !onlyPost(ctx) {
+			return
+		}
+		if err = p2p.Join(); err == nil {
+			// Nothing was advertised while we were away
+			s.RepublishContent()
+		}
+	case "/admin/network/leave":
+		if !onlyPost(ctx) {
+			return
+		}
+		err = p2p.Leave()
+	}
+	writeJSON(ctx, networkStatus{Joined: p2p.Joined()}, err)
+}
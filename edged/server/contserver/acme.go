@@ -0,0 +1,121 @@
+package contserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeChallengePath is where the CA looks for HTTP-01 challenge responses
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// acmeManager gets and renews certificates for our domains from an ACME CA,
+// answering HTTP-01 challenges on the HTTP port and TLS-ALPN-01 challenges
+// on the content port
+type acmeManager struct {
+	manager   *autocert.Manager
+	domains   map[string]bool
+	challenge fasthttp.RequestHandler
+}
+
+// newACMEManager sets up ACME if it's enabled, nil is returned if it's not
+func newACMEManager() (*acmeManager, error) {
+	if !viper.GetBool("ACME.Enabled") {
+		return nil, nil
+	}
+	if !viper.GetBool("ACME.AcceptTOS") {
+		return nil, errors.New("ACME.AcceptTOS must be set to accept the CA's terms of service")
+	}
+
+	domains := viper.GetStringSlice("ACME.Domains")
+	if len(domains) == 0 {
+		return nil, errors.New("ACME needs at least one domain in ACME.Domains")
+	}
+	domainSet := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		domainSet[strings.ToLower(d)] = true
+	}
+
+	client := &acme.Client{DirectoryURL: viper.GetString("ACME.DirectoryURL")}
+	// A test CA like Pebble serves its directory with its own root
+	if roots := viper.GetString("ACME.CARoots"); roots != "" {
+		pem, err := ioutil.ReadFile(roots)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in ACME.CARoots")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(viper.GetString("ACME.CacheDir")),
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: viper.GetDuration("ACME.RenewBefore"),
+		Client:      client,
+		Email:       viper.GetString("ACME.Email"),
+	}
+	return &acmeManager{
+		manager:   m,
+		domains:   domainSet,
+		challenge: fasthttpadaptor.NewFastHTTPHandler(m.HTTPHandler(nil)),
+	}, nil
+}
+
+// handles says if the handshake is for one of our ACME domains, or is the CA
+// checking a TLS-ALPN-01 challenge
+func (a *acmeManager) handles(hello *tls.ClientHelloInfo) bool {
+	if isALPNChallenge(hello) {
+		return true
+	}
+	return a.domains[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]
+}
+
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// httpHandler answers HTTP-01 challenges before anything else on the HTTP port
+func (a *acmeManager) httpHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if strings.HasPrefix(string(ctx.Path()), acmeChallengePath) {
+			a.challenge(ctx)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// provision gets (or loads from the cache) a certificate for each domain so
+// the first client doesn't wait on the CA, the listeners must be up so the
+// challenges can be answered
+func (a *acmeManager) provision(onCert func(*tls.Certificate)) {
+	for domain := range a.domains {
+		// Ask like a modern client so we get the ECDSA certificate most use
+		cert, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:   domain,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			log.Error().Err(err).Str("domain", domain).Msg("Error getting ACME certificate")
+			continue
+		}
+		log.Info().Str("domain", domain).Time("expires", cert.Leaf.NotAfter).Msg("ACME certificate ready")
+		onCert(cert)
+	}
+}
@@ -0,0 +1,297 @@
+package contserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/gobuffalo/packr"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/acme"
+)
+
+// certStore holds the certificate we serve content with. Certificates from
+// files are reloaded when the files change or on SIGHUP, a reload that fails
+// keeps the certificate we have.
+type certStore struct {
+	state *state.State
+
+	certFile, keyFile, chainFile string
+
+	mux  sync.RWMutex
+	cert *tls.Certificate
+
+	// Certificates for our own domains come from ACME if it's enabled
+	acme     *acmeManager
+	lastACME *tls.Certificate
+
+	watcher *fsnotify.Watcher
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+// newCertStore loads the configured certificate, or the embedded development
+// pair if that's explicitly allowed
+func newCertStore(s *state.State) (*certStore, error) {
+	cs := &certStore{
+		state:     s,
+		certFile:  viper.GetString("TLS.Cert"),
+		keyFile:   viper.GetString("TLS.Key"),
+		chainFile: viper.GetString("TLS.CAChain"),
+		done:      make(chan struct{}),
+	}
+
+	var err error
+	if cs.acme, err = newACMEManager(); err != nil {
+		return nil, err
+	}
+
+	if cs.certFile == "" && cs.keyFile == "" {
+		if viper.GetBool("TLS.DevFallback") {
+			log.Warn().Msg("Using the embedded development certificate, every node using it shares its private key")
+			return cs, cs.loadEmbedded()
+		}
+		// ACME alone is fine, but handshakes for other names will fail
+		if cs.acme != nil {
+			log.Warn().Msg("Only serving ACME certificates, clients that don't send a server name (SNI) or ask for another name can't connect. Set TLS.Cert and TLS.Key to serve them.")
+			return cs, nil
+		}
+		return nil, errors.New("no TLS certificate configured, set TLS.Cert and TLS.Key, enable ACME (or TLS.DevFallback for development)")
+	}
+	if cs.certFile == "" || cs.keyFile == "" {
+		return nil, errors.New("TLS.Cert and TLS.Key must both be set")
+	}
+
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	if err := cs.watch(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) loadEmbedded() error {
+	box := packr.NewBox("./keys")
+	cert, err := box.Find("cert.pem")
+	if err != nil {
+		return err
+	}
+	privKey, err := box.Find("privkey.pem")
+	if err != nil {
+		return err
+	}
+	cer, err := tls.X509KeyPair(cert, privKey)
+	if err != nil {
+		return err
+	}
+	return cs.set(&cer)
+}
+
+// load reads the certificate, key and CA chain files
+func (cs *certStore) load() error {
+	certPEM, err := ioutil.ReadFile(cs.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(cs.keyFile)
+	if err != nil {
+		return err
+	}
+	cer, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	// Intermediates can be kept apart from the certificate
+	if cs.chainFile != "" {
+		chainPEM, err := ioutil.ReadFile(cs.chainFile)
+		if err != nil {
+			return err
+		}
+		for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				cer.Certificate = append(cer.Certificate, block.Bytes)
+			}
+		}
+	}
+	return cs.set(&cer)
+}
+
+func (cs *certStore) set(cer *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cer.Leaf = leaf
+	if time.Now().After(leaf.NotAfter) {
+		log.Warn().Time("expired", leaf.NotAfter).Msg("The TLS certificate has expired")
+	}
+
+	cs.mux.Lock()
+	cs.cert = cer
+	cs.mux.Unlock()
+	cs.state.SetCertificate(leaf)
+	return nil
+}
+
+func (cs *certStore) reload(reason string) {
+	if err := cs.load(); err != nil {
+		log.Error().Err(err).Str("reason", reason).Msg("Error reloading TLS certificate, keeping the current one")
+		return
+	}
+	cs.mux.RLock()
+	leaf := cs.cert.Leaf
+	cs.mux.RUnlock()
+	log.Info().Str("reason", reason).Str("subject", leaf.Subject.String()).Time("expires", leaf.NotAfter).Msg("Reloaded TLS certificate")
+}
+
+// watch reloads on SIGHUP and when the files change. The directories are
+// watched as tools like certbot or Kubernetes replace files (or symlinks to
+// them) rather than writing them in place.
+func (cs *certStore) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	for _, f := range []string{cs.certFile, cs.keyFile, cs.chainFile} {
+		if f == "" {
+			continue
+		}
+		files[filepath.Clean(f)] = true
+		if err := watcher.Add(filepath.Dir(f)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	cs.watcher = watcher
+	cs.signals = make(chan os.Signal, 1)
+	signal.Notify(cs.signals, syscall.SIGHUP)
+
+	go func() {
+		// A renewal writes several files, so wait for it to settle
+		var settle <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if files[filepath.Clean(event.Name)] || filepath.Base(event.Name) == "..data" {
+					settle = time.After(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Msg("Error watching TLS certificate files")
+			case <-settle:
+				settle = nil
+				cs.reload("files changed")
+			case <-cs.signals:
+				cs.reload("SIGHUP")
+			case <-cs.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadDelay is how long the files have to be left alone before we reload
+const reloadDelay = time.Second
+
+// GetCertificate returns the ACME certificate for our ACME domains, and the
+// configured certificate for anything else
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mux.RLock()
+	cert := cs.cert
+	cs.mux.RUnlock()
+
+	if cs.acme != nil && (cert == nil || cs.acme.handles(hello)) {
+		acmeCert, err := cs.acme.manager.GetCertificate(hello)
+		switch {
+		case isALPNChallenge(hello):
+			return acmeCert, err
+		case err == nil:
+			cs.servedACME(acmeCert)
+			return acmeCert, nil
+		case cert == nil:
+			return nil, err
+		}
+		// Keep serving with our other certificate while the CA is unavailable
+		log.Debug().Err(err).Str("server_name", hello.ServerName).Msg("No ACME certificate, using the configured one")
+	}
+	if cert == nil {
+		return nil, errors.New("no certificate for " + hello.ServerName)
+	}
+	return cert, nil
+}
+
+// servedACME shows a new or renewed ACME certificate in the status
+func (cs *certStore) servedACME(cert *tls.Certificate) {
+	// Called on every handshake, so only take the write lock when it changed
+	cs.mux.RLock()
+	changed := cs.lastACME != cert
+	cs.mux.RUnlock()
+	if !changed {
+		return
+	}
+
+	cs.mux.Lock()
+	changed = cs.lastACME != cert
+	cs.lastACME = cert
+	cs.mux.Unlock()
+
+	if changed && cert.Leaf != nil {
+		cs.state.SetCertificate(cert.Leaf)
+	}
+}
+
+// tlsConfig is the content port's TLS config, with ACME it also answers
+// TLS-ALPN-01 challenges
+func (cs *certStore) tlsConfig() *tls.Config {
+	config := &tls.Config{GetCertificate: cs.GetCertificate}
+	if cs.acme != nil {
+		config.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	}
+	return config
+}
+
+// httpHandler answers ACME HTTP-01 challenges on the HTTP port if ACME is on
+func (cs *certStore) httpHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if cs.acme == nil {
+		return next
+	}
+	return cs.acme.httpHandler(next)
+}
+
+// provision gets the ACME certificates in the background once we're listening
+func (cs *certStore) provision() {
+	if cs.acme != nil {
+		go cs.acme.provision(cs.servedACME)
+	}
+}
+
+// Close stops watching for changes
+func (cs *certStore) Close() {
+	if cs.watcher == nil {
+		return
+	}
+	signal.Stop(cs.signals)
+	close(cs.done)
+	cs.watcher.Close()
+}
@@ -0,0 +1,217 @@
+package contserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/state"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/acme"
+)
+
+// writeTestCert writes a self signed certificate for name and its key as
+// cert.pem and key.pem in dir
+func writeTestCert(t *testing.T, dir, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the files like certbot does rather than writing them in place
+	for file, block := range map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		tmp := filepath.Join(dir, "."+file)
+		if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate handshakes get
+func servedName(t *testing.T, cs *certStore) string {
+	t.Helper()
+	cert, err := cs.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("no certificate served, err = %v", err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestNewCertStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		wantErr bool
+	}{
+		{"no certificate", map[string]interface{}{}, true},
+		{"development certificate", map[string]interface{}{"TLS.DevFallback": true}, false},
+		{"certificate without a key", map[string]interface{}{"TLS.Cert": "cert.pem"}, true},
+		{"missing files", map[string]interface{}{"TLS.Cert": "missing.pem", "TLS.Key": "missing.pem"}, true},
+		{"ACME without accepting the terms", map[string]interface{}{"ACME.Enabled": true, "ACME.Domains": []string{"example.com"}}, true},
+		{"ACME without domains", map[string]interface{}{"ACME.Enabled": true, "ACME.AcceptTOS": true}, true},
+		{"ACME only", map[string]interface{}{"ACME.Enabled": true, "ACME.AcceptTOS": true, "ACME.Domains": []string{"example.com"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set("ACME.CacheDir", t.TempDir())
+			for k, v := range tt.config {
+				viper.Set(k, v)
+			}
+			cs, err := newCertStore(&state.State{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cs != nil {
+				cs.Close()
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	writeTestCert(t, dir, "old.example.com")
+	viper.Set("TLS.Cert", filepath.Join(dir, "cert.pem"))
+	viper.Set("TLS.Key", filepath.Join(dir, "key.pem"))
+
+	cs, err := newCertStore(&state.State{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	if name := servedName(t, cs); name != "old.example.com" {
+		t.Fatalf("serving %s", name)
+	}
+
+	// A renewal is picked up once the files settle
+	writeTestCert(t, dir, "new.example.com")
+	deadline := time.Now().Add(5 * reloadDelay)
+	for servedName(t, cs) != "new.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate wasn't loaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// A broken renewal keeps what we have
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cs.reload("test")
+	if name := servedName(t, cs); name != "new.example.com" {
+		t.Errorf("serving %s after a failed reload", name)
+	}
+}
+
+func TestACMEHandles(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("ACME.Enabled", true)
+	viper.Set("ACME.AcceptTOS", true)
+	viper.Set("ACME.Domains", []string{"Node.example.com"})
+	viper.Set("ACME.CacheDir", t.TempDir())
+	a, err := newACMEManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		hello *tls.ClientHelloInfo
+		want  bool
+	}{
+		{"our domain", &tls.ClientHelloInfo{ServerName: "node.example.com"}, true},
+		{"fully qualified", &tls.ClientHelloInfo{ServerName: "node.example.com."}, true},
+		{"another name", &tls.ClientHelloInfo{ServerName: "other.example.com"}, false},
+		{"no name", &tls.ClientHelloInfo{}, false},
+		{"challenge", &tls.ClientHelloInfo{ServerName: "other.example.com", SupportedProtos: []string{acme.ALPNProto}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.handles(tt.hello); got != tt.want {
+				t.Errorf("handles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("ACME.Enabled", true)
+	viper.Set("ACME.AcceptTOS", true)
+	viper.Set("ACME.Domains", []string{"node.example.com"})
+	viper.Set("ACME.CacheDir", t.TempDir())
+	cs, err := newCertStore(&state.State{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	tests := []struct {
+		path     string
+		wantNext bool
+	}{
+		{"/content", true},
+		{acmeChallengePath + "token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			calledNext := false
+			handler := cs.httpHandler(func(*fasthttp.RequestCtx) { calledNext = true })
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tt.path)
+			ctx.Request.SetHost("node.example.com")
+			handler(ctx)
+			if calledNext != tt.wantNext {
+				t.Errorf("passed on = %v, want %v", calledNext, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestServedACME(t *testing.T) {
+	cs := &certStore{}
+	first, renewed := &tls.Certificate{}, &tls.Certificate{}
+
+	for _, cert := range []*tls.Certificate{first, first, renewed, renewed} {
+		cs.servedACME(cert)
+		if cs.lastACME != cert {
+			t.Fatal("the served certificate wasn't remembered")
+		}
+	}
+}
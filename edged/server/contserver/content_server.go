@@ -1,14 +1,24 @@
 package contserver
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
-	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"time"
 
+	"github.com/gladiusio/gladius-edged/edged/accesslog"
+	"github.com/gladiusio/gladius-edged/edged/health"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
 	"github.com/gladiusio/gladius-edged/edged/state"
-	"github.com/gobuffalo/packr"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // ContentServer is a server that serves the gladius content from the state
@@ -19,11 +29,14 @@ type ContentServer struct {
 	contentListener net.Listener
 	tlsListener     net.Listener
 	state           *state.State
+	p2p             *handler.P2PHandler
+	accessLog       *accesslog.Logger
+	certs           *certStore
 }
 
 // New creates a new content server and starts it
-func New(state *state.State, httpsPort, httpPort string) *ContentServer {
-	cs := &ContentServer{state: state, running: false, httpsPort: httpsPort, httpPort: httpPort}
+func New(state *state.State, p2p *handler.P2PHandler, httpsPort, httpPort string) *ContentServer {
+	cs := &ContentServer{state: state, p2p: p2p, running: false, httpsPort: httpsPort, httpPort: httpPort}
 	cs.Start()
 	return cs
 }
@@ -33,31 +46,24 @@ func (cs *ContentServer) Start() {
 	if !cs.running {
 		var err error
 
-		box := packr.NewBox("./keys")
-		cert, err := box.Find("cert.pem")
+		cs.accessLog, err = accesslog.New()
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error loading certificate")
-		}
-
-		privKey, err := box.Find("privkey.pem")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error loading private key (tls)")
+			log.Fatal().Err(err).Msg("Error opening access log")
 		}
 
-		// Listen on TLS
-		cer, err := tls.X509KeyPair(cert, privKey)
+		cs.certs, err = newCertStore(cs.state)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error loading certificate")
 		}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		cs.tlsListener, err = tls.Listen("tcp", ":"+cs.httpsPort, config)
+		// Listen on TLS, the certificate can change while we're running
+		cs.tlsListener, err = tls.Listen("tcp", ":"+cs.httpsPort, cs.certs.tlsConfig())
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error starting TLS server on address")
 		}
 
 		// Listen for http over tls connection
-		tlsServer := fasthttp.Server{Handler: requestHandler(cs.state)}
+		tlsServer := fasthttp.Server{Handler: requestHandler(cs.state, cs.p2p, cs.accessLog)}
 		go tlsServer.Serve(cs.tlsListener)
 
 		// Listen on http
@@ -66,11 +72,14 @@ func (cs *ContentServer) Start() {
 			log.Fatal().Err(err).Msg("Error starting HTTP server on address")
 		}
 		// Create a content server
-		server := fasthttp.Server{Handler: requestHandler(cs.state)}
+		server := fasthttp.Server{Handler: cs.certs.httpHandler(requestHandler(cs.state, cs.p2p, cs.accessLog))}
 
 		// Serve the content
 		go server.Serve(cs.contentListener)
 
+		// Both ports are up so ACME challenges can be answered
+		cs.certs.provision()
+
 		cs.running = true
 	}
 }
@@ -82,28 +91,107 @@ func (cs *ContentServer) Stop() {
 			cs.contentListener.Close()
 			cs.running = false
 		}
+		if cs.tlsListener != nil {
+			cs.tlsListener.Close()
+		}
+		cs.certs.Close()
+		cs.accessLog.Close()
 	}
 }
 
 // Return a function like the one fasthttp is expecting
-func requestHandler(s *state.State) func(ctx *fasthttp.RequestCtx) {
+func requestHandler(s *state.State, p2p *handler.P2PHandler, accessLog *accesslog.Logger) func(ctx *fasthttp.RequestCtx) {
+	readyzHandler := health.ReadyzHandler(s, p2p)
+
 	// The actual serving function
-	return func(ctx *fasthttp.RequestCtx) {
+	serve := func(tctx context.Context, ctx *fasthttp.RequestCtx) {
 		setupCORS(ctx)
 		switch string(ctx.Path()) {
 		case "/content":
-			contentHandler(ctx, s)
-		case "/status":
-			fmt.Fprintf(ctx, s.Info())
-		case "/version":
-			fmt.Fprint(ctx, `{"response":{"version":"0.9.0"}}`)
+			contentHandler(tctx, ctx, s)
+		case "/bulk":
+			bulkHandler(ctx, s)
+		// Orchestrators probe the content ports, the admin listener is local
+		case "/healthz":
+			health.HealthzHandler(ctx)
+		case "/readyz":
+			readyzHandler(ctx)
 		default:
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
 	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		route := routeLabel(string(ctx.Path()))
+		tctx, span := tracing.StartServer(ctx, "HTTP "+route)
+
+		serve(tctx, ctx)
+		observeRequest(ctx, s, route, start)
+		logRequest(ctx, accessLog, start)
+
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", ctx.Response.StatusCode()),
+			attribute.String("content.website", string(ctx.QueryArgs().Peek("website"))),
+			attribute.String("content.asset", string(ctx.QueryArgs().Peek("asset"))),
+		)
+		if ctx.Response.StatusCode() >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		span.End()
+	}
+}
+
+// routes are the route labels of our metrics, anything else is "other"
+var routes = map[string]bool{"/content": true, "/bulk": true, "/healthz": true, "/readyz": true}
+
+func routeLabel(path string) string {
+	if routes[path] {
+		return path
+	}
+	return "other"
 }
 
-func contentHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+func observeRequest(ctx *fasthttp.RequestCtx, s *state.State, route string, start time.Time) {
+	status := ctx.Response.StatusCode()
+	// Only content requests are labeled with their website
+	website := ""
+	if route == "/content" {
+		website = s.MetricsWebsite(string(ctx.QueryArgs().Peek("website")), status)
+	}
+
+	labels := []string{route, strconv.Itoa(status), website}
+	metrics.Requests.WithLabelValues(labels...).Inc()
+	metrics.RequestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+func logRequest(ctx *fasthttp.RequestCtx, accessLog *accesslog.Logger, start time.Time) {
+	if accessLog == nil {
+		return
+	}
+
+	// Streamed bodies (pull-through and bulk) aren't buffered, so use their length
+	bytes := int64(len(ctx.Response.Body()))
+	if ctx.Response.IsBodyStream() {
+		bytes = int64(ctx.Response.Header.ContentLength())
+	}
+	accessLog.Log(&accesslog.Entry{
+		Time:      start,
+		ClientIP:  ctx.RemoteIP().String(),
+		Method:    string(ctx.Method()),
+		URI:       string(ctx.RequestURI()),
+		Website:   string(ctx.QueryArgs().Peek("website")),
+		Asset:     string(ctx.QueryArgs().Peek("asset")),
+		Status:    ctx.Response.StatusCode(),
+		Bytes:     bytes,
+		Duration:  time.Since(start),
+		TLS:       ctx.IsTLS(),
+		UserAgent: string(ctx.UserAgent()),
+		Referer:   string(ctx.Referer()),
+	})
+}
+
+func contentHandler(tctx context.Context, ctx *fasthttp.RequestCtx, s *state.State) {
 	// URL format like /content?website=REQUESTED_SITE?asset=FILE_HASH
 	website := string(ctx.QueryArgs().Peek("website"))
 	asset := string(ctx.QueryArgs().Peek("asset"))
@@ -113,14 +201,77 @@ func contentHandler(ctx *fasthttp.RequestCtx, s *state.State) {
 		if a != nil && len(a) > 0 {
 			ctx.SetStatusCode(fasthttp.StatusOK)
 			ctx.Write(a)
+			s.RecordRequest(website, asset, fasthttp.StatusOK, int64(len(a)), true)
+		} else if stream, size, err := s.PullAsset(tctx, website, asset); err == nil {
+			// We didn't have it, but a peer did so stream it through. It's
+			// recorded once we know how much of it the client got.
+			ctx.SetStatusCode(fasthttp.StatusOK)
+			ctx.SetBodyStream(&servedStream{ReadCloser: stream, done: func(n int64) {
+				s.RecordRequest(website, asset, fasthttp.StatusOK, n, false)
+			}}, size)
 		} else {
 			ctx.SetStatusCode(fasthttp.StatusNotFound)
 			ctx.Write([]byte("404 - Asset not found"))
+			s.RecordRequest(website, asset, fasthttp.StatusNotFound, 0, false)
 		}
 	} else {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		ctx.Write([]byte(`Must specify asset in URL, like /content?website=REQUESTED_SITE&asset=FILE_HASH`))
+		s.RecordRequest(website, asset, fasthttp.StatusBadRequest, 0, false)
+	}
+}
+
+// servedStream counts the bytes of a pulled asset a client was sent
+type servedStream struct {
+	io.ReadCloser
+	read int64
+	done func(read int64)
+}
+
+func (r *servedStream) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *servedStream) Close() error {
+	r.done(r.read)
+	return r.ReadCloser.Close()
+}
+
+func bulkHandler(ctx *fasthttp.RequestCtx, s *state.State) {
+	// GET /bulk?website=REQUESTED_SITE for a whole website, or POST a list of
+	// content like {"content": ["REQUESTED_SITE/FILE_HASH"]}
+	website := string(ctx.QueryArgs().Peek("website"))
+	var content []string
+	if ctx.IsPost() {
+		var err error
+		content, err = state.ParseBulkRequest(ctx.PostBody())
+		if err != nil {
+			ctx.Error("Invalid bulk request", fasthttp.StatusBadRequest)
+			return
+		}
+	} else if website == "" {
+		ctx.Error("Must specify website in URL, like /bulk?website=REQUESTED_SITE, or POST a content list", fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Every archive reads its assets from disk, so only serve a few at a time
+	done, ok := s.ServeBulk()
+	if !ok {
+		ctx.Response.Header.Set("Retry-After", "60")
+		ctx.Error("Too many bulk requests, try again later", fasthttp.StatusTooManyRequests)
+		return
 	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/zstd")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer done()
+		if err := s.WriteBulk(w, website, content); err != nil {
+			log.Warn().Err(err).Msg("Error streaming bulk content to peer")
+		}
+	})
 }
 
 func setupCORS(ctx *fasthttp.RequestCtx) {
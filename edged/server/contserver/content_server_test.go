@@ -0,0 +1,61 @@
+package contserver
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestServedStream(t *testing.T) {
+	tests := []struct {
+		name string
+		read int
+		want int64
+	}{
+		{"whole asset", -1, 11},
+		{"client went away", 4, 4},
+		{"nothing read", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int64 = -1
+			r := &servedStream{
+				ReadCloser: ioutil.NopCloser(strings.NewReader("hello world")),
+				done:       func(n int64) { got = n },
+			}
+			if tt.read < 0 {
+				ioutil.ReadAll(r)
+			} else {
+				r.Read(make([]byte, tt.read))
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("recorded %d bytes, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestHandlerHealth(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/healthz", fasthttp.StatusOK},
+		{"/nowhere", fasthttp.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(tt.path)
+			requestHandler(nil, nil, nil)(ctx)
+			if got := ctx.Response.StatusCode(); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got, tt.wantStatus)
+			}
+		})
+	}
+}
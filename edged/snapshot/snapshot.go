@@ -0,0 +1,470 @@
+// Package snapshot exports the content of an edged to an archive and imports
+// it into another, used to seed new nodes without syncing from the network
+package snapshot
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// ManifestName is the name of the manifest entry, it is always the first entry
+// in an archive
+const ManifestName = "manifest.json"
+
+// manifestVersion is bumped whenever the archive layout changes
+const manifestVersion = 1
+
+// Asset is a single file in an archive
+type Asset struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes everything in an archive
+type Manifest struct {
+	Version  int                `json:"version"`
+	Created  time.Time          `json:"created"`
+	Websites map[string][]Asset `json:"websites"`
+}
+
+// Assets returns the number of assets in the manifest
+func (m *Manifest) Assets() int {
+	count := 0
+	for _, assets := range m.Websites {
+		count += len(assets)
+	}
+	return count
+}
+
+// NewManifest returns an empty manifest
+func NewManifest() *Manifest {
+	return &Manifest{Version: manifestVersion, Created: time.Now().UTC(), Websites: make(map[string][]Asset)}
+}
+
+func (m *Manifest) find(website, asset string) (Asset, bool) {
+	for _, a := range m.Websites[website] {
+		if a.Name == asset {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// validName makes sure a website or asset name from an archive can't escape
+// the content directory
+func validName(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`) &&
+		!strings.HasSuffix(name, "_temp")
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%X", h.Sum(nil)), size, nil
+}
+
+// BuildManifest hashes the content of the websites (every website if empty),
+// assets that don't match their hash are left out
+func BuildManifest(contentDir string, websites []string) (*Manifest, error) {
+	if len(websites) == 0 {
+		files, err := ioutil.ReadDir(contentDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() && validName(f.Name()) {
+				websites = append(websites, f.Name())
+			}
+		}
+	}
+
+	m := NewManifest()
+	for _, website := range websites {
+		if !validName(website) {
+			return nil, errors.New("invalid website name: " + website)
+		}
+		files, err := ioutil.ReadDir(filepath.Join(contentDir, website))
+		if err != nil {
+			return nil, err
+		}
+
+		assets := make([]Asset, 0, len(files))
+		for _, f := range files {
+			if f.IsDir() || !validName(f.Name()) {
+				continue
+			}
+			sum, size, err := hashFile(filepath.Join(contentDir, website, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if sum != strings.ToUpper(f.Name()) {
+				log.Warn().Str("website", website).Str("asset", f.Name()).Msg("Asset doesn't match its hash, leaving it out of the snapshot")
+				continue
+			}
+			assets = append(assets, Asset{Name: f.Name(), Size: size, SHA256: sum})
+		}
+		sort.Slice(assets, func(i, j int) bool { return assets[i].Name < assets[j].Name })
+		m.Websites[website] = assets
+	}
+	return m, nil
+}
+
+// WriteArchive writes the manifest followed by every asset in it as a tar
+// stream
+func WriteArchive(w io.Writer, contentDir string, m *Manifest) error {
+	return WriteArchiveFrom(w, m, func(website, asset string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(contentDir, website, asset))
+	})
+}
+
+// ErrSkipAsset can be returned by the open function of WriteArchiveFrom to
+// leave an asset out of the archive, like one removed since the manifest was
+// built
+var ErrSkipAsset = errors.New("asset skipped")
+
+// WriteArchiveFrom writes the manifest followed by every asset in it as a tar
+// stream, reading the assets with open
+func WriteArchiveFrom(w io.Writer, m *Manifest, open func(website, asset string) (io.ReadCloser, error)) error {
+	tw := tar.NewWriter(w)
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(b)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	websites := make([]string, 0, len(m.Websites))
+	for website := range m.Websites {
+		websites = append(websites, website)
+	}
+	sort.Strings(websites)
+
+	for _, website := range websites {
+		for _, a := range m.Websites[website] {
+			if err := writeEntry(tw, open, website, a); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeEntry(tw *tar.Writer, open func(website, asset string) (io.ReadCloser, error), website string, a Asset) error {
+	r, err := open(website, a.Name)
+	if err == ErrSkipAsset {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hdr := &tar.Header{Name: website + "/" + a.Name, Mode: 0644, Size: a.Size, ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, a.Size)
+	return err
+}
+
+// Export writes a zstd compressed archive of the websites (every website if
+// empty) in the content directory
+func Export(w io.Writer, contentDir string, websites []string) (*Manifest, error) {
+	m, err := BuildManifest(contentDir, websites)
+	if err != nil {
+		return nil, err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteArchive(zw, contentDir, m); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	return m, zw.Close()
+}
+
+// Import reads a zstd compressed archive into the content directory
+func Import(r io.Reader, contentDir string) (*Manifest, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return ReadArchive(zr, contentDir)
+}
+
+// ReadArchive verifies every asset in a tar stream against its hash and the
+// manifest, then moves them into the content directory. Nothing is written to
+// the content directory unless the whole archive is valid, and the assets are
+// moved in one burst so the content watcher only reloads once.
+func ReadArchive(r io.Reader, contentDir string) (*Manifest, error) {
+	// Stage inside the content directory so the final move is a rename on the
+	// same filesystem, the content watcher ignores hidden directories
+	if err := os.MkdirAll(contentDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	staging, err := ioutil.TempDir(contentDir, ".import")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	m, err := stageArchive(r, staging)
+	if err != nil {
+		return nil, err
+	}
+	if err := moveIntoPlace(staging, contentDir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// stageArchive extracts and verifies an archive into the staging directory
+func stageArchive(r io.Reader, staging string) (*Manifest, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != ManifestName {
+		return nil, errors.New("archive doesn't start with a manifest")
+	}
+	m := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	// Count each manifest entry once, so an archive can't repeat one asset in
+	// place of another
+	seen := make(map[string]bool, m.Assets())
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 2 || !validName(parts[0]) || !validName(parts[1]) {
+			return nil, errors.New("invalid entry in archive: " + hdr.Name)
+		}
+		website, asset := parts[0], parts[1]
+		expected, ok := m.find(website, asset)
+		if !ok {
+			return nil, errors.New("entry not in the manifest: " + hdr.Name)
+		}
+		if seen[hdr.Name] {
+			return nil, errors.New("duplicate entry in archive: " + hdr.Name)
+		}
+
+		if err := stageEntry(tr, staging, website, asset, expected); err != nil {
+			return nil, err
+		}
+		seen[hdr.Name] = true
+	}
+
+	if len(seen) != m.Assets() {
+		return nil, fmt.Errorf("archive is missing assets, expected %d got %d", m.Assets(), len(seen))
+	}
+	return m, nil
+}
+
+func stageEntry(r io.Reader, staging, website, asset string, expected Asset) error {
+	if err := os.MkdirAll(filepath.Join(staging, website), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(filepath.Join(staging, website, asset))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), r); err != nil {
+		return err
+	}
+
+	// The name of an asset is its hash
+	actual := fmt.Sprintf("%X", h.Sum(nil))
+	if actual != strings.ToUpper(asset) || actual != strings.ToUpper(expected.SHA256) {
+		return fmt.Errorf("asset %s/%s did not match expected hash, got: %s", website, asset, actual)
+	}
+	return nil
+}
+
+// moveIntoPlace moves the staged websites into the content directory, new
+// websites are moved as a whole
+func moveIntoPlace(staging, contentDir string) error {
+	if err := os.MkdirAll(contentDir, os.ModePerm); err != nil {
+		return err
+	}
+	websites, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range websites {
+		from := filepath.Join(staging, w.Name())
+		to := filepath.Join(contentDir, w.Name())
+		if _, err := os.Stat(to); os.IsNotExist(err) {
+			if err := os.Rename(from, to); err != nil {
+				return err
+			}
+			continue
+		}
+
+		assets, err := ioutil.ReadDir(from)
+		if err != nil {
+			return err
+		}
+		for _, a := range assets {
+			if err := os.Rename(filepath.Join(from, a.Name()), filepath.Join(to, a.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Receive reads an archive from a peer straight into the content directory.
+// Unlike Import every asset is verified and kept on its own, so one bad asset
+// doesn't throw away the rest. accept is called with the size of an asset
+// before it is read and can refuse it. The content names (<website>/<asset>)
+// stored are returned.
+func Receive(r io.Reader, contentDir string, accept func(website, asset string, size int64) error) ([]string, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != ManifestName {
+		return nil, errors.New("archive doesn't start with a manifest")
+	}
+	m := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	received := make([]string, 0, m.Assets())
+	seen := make(map[string]bool, m.Assets())
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return received, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 2 || !validName(parts[0]) || !validName(parts[1]) {
+			log.Warn().Str("entry", hdr.Name).Msg("Skipping invalid entry in archive")
+			continue
+		}
+		website, asset := parts[0], parts[1]
+		expected, ok := m.find(website, asset)
+		if !ok {
+			log.Warn().Str("entry", hdr.Name).Msg("Skipping entry that isn't in the manifest")
+			continue
+		}
+		if seen[hdr.Name] {
+			log.Warn().Str("entry", hdr.Name).Msg("Skipping duplicate entry in archive")
+			continue
+		}
+		seen[hdr.Name] = true
+
+		if err := accept(website, asset, hdr.Size); err != nil {
+			log.Warn().Err(err).Str("entry", hdr.Name).Msg("Skipping asset from archive")
+			continue
+		}
+		if err := receiveEntry(tr, contentDir, website, asset, expected); err != nil {
+			log.Warn().Err(err).Str("entry", hdr.Name).Msg("Skipping asset from archive")
+			continue
+		}
+		received = append(received, hdr.Name)
+	}
+	return received, nil
+}
+
+func receiveEntry(r io.Reader, contentDir, website, asset string, expected Asset) error {
+	dir := filepath.Join(contentDir, website)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// The content watcher ignores temp files until they are renamed
+	out, err := ioutil.TempFile(dir, asset+"*_temp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), r)
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	actual := fmt.Sprintf("%X", h.Sum(nil))
+	if actual != strings.ToUpper(asset) || actual != strings.ToUpper(expected.SHA256) {
+		metrics.HashMismatches.Inc()
+		return fmt.Errorf("incoming file from peer did not match expected hash. Expecting: %s, got: %s", strings.ToUpper(asset), actual)
+	}
+	return os.Rename(out.Name(), filepath.Join(dir, asset))
+}
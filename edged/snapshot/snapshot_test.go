@@ -0,0 +1,168 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func hashName(data []byte) string {
+	return fmt.Sprintf("%X", sha256.Sum256(data))
+}
+
+type entry struct {
+	name string
+	data []byte
+}
+
+// buildArchive writes a tar stream with the manifest followed by the entries,
+// in order and without checking them against the manifest
+func buildArchive(t *testing.T, m *Manifest, entries []entry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := append([]entry{{ManifestName, b}}, entries...)
+	for _, e := range all {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "edged-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestReadArchive(t *testing.T) {
+	a, b := []byte("asset a"), []byte("asset b")
+	nameA, nameB := hashName(a), hashName(b)
+	m := NewManifest()
+	m.Websites["site"] = []Asset{
+		{Name: nameA, Size: int64(len(a)), SHA256: nameA},
+		{Name: nameB, Size: int64(len(b)), SHA256: nameB},
+	}
+
+	tests := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+	}{
+		{"valid", []entry{{"site/" + nameA, a}, {"site/" + nameB, b}}, false},
+		{"missing asset", []entry{{"site/" + nameA, a}}, true},
+		{"duplicate in place of another", []entry{{"site/" + nameA, a}, {"site/" + nameA, a}}, true},
+		{"hash mismatch", []entry{{"site/" + nameA, b}, {"site/" + nameB, b}}, true},
+		{"not in the manifest", []entry{{"site/" + nameA, a}, {"site/" + nameB, b}, {"other/" + nameA, a}}, true},
+		{"escapes the content directory", []entry{{"../" + nameA, a}}, true},
+		{"nested path", []entry{{"site/sub/" + nameA, a}}, true},
+		{"temp file name", []entry{{"site/" + nameA + "_temp", a}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentDir := filepath.Join(tempDir(t), "content")
+
+			_, err := ReadArchive(buildArchive(t, m, tt.entries), contentDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// Nothing is written unless the whole archive is valid
+			files, _ := ioutil.ReadDir(filepath.Join(contentDir, "site"))
+			if want := map[bool]int{true: 0, false: 2}[tt.wantErr]; len(files) != want {
+				t.Errorf("%d assets in the content directory, want %d", len(files), want)
+			}
+			websites, _ := ioutil.ReadDir(contentDir)
+			for _, w := range websites {
+				if w.Name()[0] == '.' {
+					t.Errorf("staging directory %s left in the content directory", w.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestReadArchiveNoManifest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "site/asset", Mode: 0644})
+	tw.Close()
+
+	if _, err := ReadArchive(buf, filepath.Join(tempDir(t), "content")); err == nil {
+		t.Error("read an archive without a manifest")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	from := filepath.Join(tempDir(t), "content")
+	good := []byte("good")
+	for website, assets := range map[string]map[string][]byte{
+		"a": {hashName(good): good},
+		"b": {hashName(good): good, hashName([]byte("x")): []byte("corrupted")},
+	} {
+		os.MkdirAll(filepath.Join(from, website), os.ModePerm)
+		for name, data := range assets {
+			if err := ioutil.WriteFile(filepath.Join(from, website, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		websites []string
+		want     []string
+	}{
+		{nil, []string{"a", "b"}},
+		{[]string{"b"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.websites), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			exported, err := Export(buf, from, tt.websites)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Assets that don't match their hash are left out
+			if exported.Assets() != len(tt.want) {
+				t.Errorf("exported %d assets, want %d", exported.Assets(), len(tt.want))
+			}
+
+			to := filepath.Join(tempDir(t), "content")
+			if _, err := Import(buf, to); err != nil {
+				t.Fatal(err)
+			}
+			files, _ := ioutil.ReadDir(to)
+			got := make([]string, 0, len(files))
+			for _, f := range files {
+				got = append(got, f.Name())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imported websites %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Ways we can advertise a filter of our content next to (or instead of) the
+// exact list
+const (
+	filterOff      = "off"
+	filterWithList = "with_list"
+	filterOnly     = "only"
+)
+
+// advertiser keeps track of what we last told the network we have so it can
+// send deltas instead of the full list of our content every time
+type advertiser struct {
+	mux             sync.Mutex
+	version         uint64
+	published       bool
+	advertised      map[string]struct{}
+	deltas          int
+	lastSnapshot    time.Time
+	filterSupported bool
+}
+
+func newAdvertiser() *advertiser {
+	// Start from the current time so our versions keep going up across restarts
+	return &advertiser{version: uint64(time.Now().UnixNano() / int64(time.Millisecond))}
+}
+
+// currentVersion returns the content version the network knows about, or 0
+// if we haven't published a versioned list yet
+func (a *advertiser) currentVersion() uint64 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if !a.published {
+		return 0
+	}
+	return a.version
+}
+
+// setFilterSupported records whether the gateway told us it understands
+// content filters, until it does we always send the exact list
+func (a *advertiser) setFilterSupported(supported bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if supported != a.filterSupported {
+		log.Debug().Bool("supported", supported).Msg("Network gateway content filter support changed")
+		// Start over with a snapshot so the gateway has a complete view
+		a.advertised = nil
+	}
+	a.filterSupported = supported
+}
+
+// requestSnapshot makes the next publish a full snapshot
+func (a *advertiser) requestSnapshot() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.advertised = nil
+}
+
+// filterFields returns the filter of our content to publish, or nil if we
+// aren't advertising one
+func filterFields(content []string, version uint64) map[string]interface{} {
+	if viper.GetString("Advertise.Filter") == filterOff {
+		return nil
+	}
+
+	f := newBloomFilter(len(content), viper.GetFloat64("Advertise.FilterFalsePositiveRate"), viper.GetInt("Advertise.FilterMaxBytes"))
+	for _, c := range content {
+		f.add(c)
+	}
+	return f.advertisement(version)
+}
+
+// publish tells the network about our content. With deltas enabled only the
+// content added or removed since the last version is sent, with a full
+// snapshot every so often so the gateway can't drift too far. A filter of our
+// content can be sent along with the list, or in place of it to gateways
+// that support it.
+func (a *advertiser) publish(p2p *handler.P2PHandler, content []string) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if viper.GetString("Advertise.Filter") == filterOnly && a.filterSupported {
+		version := a.version + 1
+		err := p2p.UpdateFieldsJSON(map[string]interface{}{
+			"disk_content_filter":  filterFields(content, version),
+			"disk_content_version": version,
+		})
+		if err != nil {
+			return err
+		}
+		a.version = version
+		a.published = true
+		// The gateway no longer has our exact list to apply deltas to
+		a.advertised = nil
+		log.Debug().Uint64("version", version).Int("content", len(content)).Msg("Published disk content filter")
+		return nil
+	}
+
+	if !viper.GetBool("Advertise.Deltas") {
+		filter := filterFields(content, a.version)
+		if filter == nil {
+			return p2p.UpdateField("disk_content", content...)
+		}
+		return p2p.UpdateFieldsJSON(map[string]interface{}{
+			"disk_content":        content,
+			"disk_content_filter": filter,
+		})
+	}
+
+	current := make(map[string]struct{}, len(content))
+	for _, c := range content {
+		current[c] = struct{}{}
+	}
+
+	snapshotDue := a.advertised == nil ||
+		a.deltas >= viper.GetInt("Advertise.SnapshotEvery") ||
+		time.Since(a.lastSnapshot) >= viper.GetDuration("Advertise.SnapshotInterval")
+
+	if snapshotDue {
+		version := a.version + 1
+		fields := map[string]interface{}{
+			"disk_content":         content,
+			"disk_content_version": version,
+		}
+		if filter := filterFields(content, version); filter != nil {
+			fields["disk_content_filter"] = filter
+		}
+		if err := p2p.UpdateFieldsJSON(fields); err != nil {
+			return err
+		}
+		a.version = version
+		a.published = true
+		a.advertised = current
+		a.deltas = 0
+		a.lastSnapshot = time.Now()
+		log.Debug().Uint64("version", version).Int("content", len(content)).Msg("Published full disk content snapshot")
+		return nil
+	}
+
+	added := make([]string, 0)
+	for c := range current {
+		if _, ok := a.advertised[c]; !ok {
+			added = append(added, c)
+		}
+	}
+	removed := make([]string, 0)
+	for c := range a.advertised {
+		if _, ok := current[c]; !ok {
+			removed = append(removed, c)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	version := a.version + 1
+	fields := map[string]interface{}{
+		"disk_content_delta": map[string]interface{}{
+			"base_version": a.version,
+			"version":      version,
+			"added":        added,
+			"removed":      removed,
+		},
+		"disk_content_version": version,
+	}
+	if filter := filterFields(content, version); filter != nil {
+		fields["disk_content_filter"] = filter
+	}
+	if err := p2p.UpdateFieldsJSON(fields); err != nil {
+		// We keep what we last advertised so the next delta covers this one too
+		return err
+	}
+	a.version = version
+	a.advertised = current
+	a.deltas++
+	log.Debug().
+		Uint64("version", version).
+		Int("added", len(added)).
+		Int("removed", len(removed)).
+		Msg("Published disk content delta")
+	return nil
+}
+
+// startSnapshotTicker makes sure a full snapshot goes out periodically even if
+// our content isn't changing, it's published like any other change so it
+// never holds the lock while talking to the gateway
+func (s *State) startSnapshotTicker() {
+	if !viper.GetBool("Advertise.Deltas") && viper.GetString("Advertise.Filter") != filterOnly {
+		return
+	}
+
+	s.p2p.BlockUntilJoined()
+	ticker := time.NewTicker(viper.GetDuration("Advertise.SnapshotInterval"))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ads.requestSnapshot()
+		s.advertiseContent()
+	}
+}
@@ -0,0 +1,235 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/spf13/viper"
+)
+
+// fakeGateway signs messages by echoing them and records the node fields
+// pushed to the network
+type fakeGateway struct {
+	mux    sync.Mutex
+	pushes []map[string]json.RawMessage
+}
+
+func newFakeGateway(t *testing.T) (*fakeGateway, *handler.P2PHandler) {
+	g := &fakeGateway{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/message/sign":
+			w.Write([]byte(`{"success": true, "response": ` + string(body) + `}`))
+		case "/state/push_message":
+			var msg struct {
+				Message struct {
+					Node map[string]json.RawMessage `json:"node"`
+				} `json:"message"`
+			}
+			json.Unmarshal(body, &msg)
+			g.mux.Lock()
+			g.pushes = append(g.pushes, msg.Message.Node)
+			g.mux.Unlock()
+			w.Write([]byte(`{"success": true}`))
+		case "/network/join", "/network/leave":
+			w.Write([]byte(`{"success": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return g, handler.New(server.URL, "", "", "", "")
+}
+
+func (g *fakeGateway) last() map[string]json.RawMessage {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if len(g.pushes) == 0 {
+		return nil
+	}
+	return g.pushes[len(g.pushes)-1]
+}
+
+func (g *fakeGateway) count() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.pushes)
+}
+
+func TestAdvertiserDeltas(t *testing.T) {
+	viper.Set("Advertise.Deltas", true)
+	viper.Set("Advertise.SnapshotEvery", 50)
+	viper.Set("Advertise.SnapshotInterval", time.Hour)
+	viper.Set("Advertise.Filter", filterOff)
+	defer viper.Reset()
+
+	g, p2p := newFakeGateway(t)
+	a := newAdvertiser()
+
+	type delta struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}
+	steps := []struct {
+		name     string
+		snapshot bool
+		content  []string
+		want     string
+		delta    delta
+	}{
+		{"first publish is a snapshot", false, []string{"site/a"}, "disk_content", delta{}},
+		{"additions are a delta", false, []string{"site/a", "site/b"}, "disk_content_delta", delta{Added: []string{"site/b"}, Removed: []string{}}},
+		{"removals are a delta", false, []string{"site/b"}, "disk_content_delta", delta{Added: []string{}, Removed: []string{"site/a"}}},
+		{"no change publishes nothing", false, []string{"site/b"}, "", delta{}},
+		{"requested snapshot", true, []string{"site/b"}, "disk_content", delta{}},
+	}
+	for _, step := range steps {
+		before := g.count()
+		if step.snapshot {
+			a.requestSnapshot()
+		}
+		if err := a.publish(p2p, step.content); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if step.want == "" {
+			if g.count() != before {
+				t.Errorf("%s: published %v", step.name, g.last())
+			}
+			continue
+		}
+		fields := g.last()
+		if _, ok := fields[step.want]; !ok || g.count() != before+1 {
+			t.Errorf("%s: published %v, want %s", step.name, fields, step.want)
+			continue
+		}
+		if step.want == "disk_content_delta" {
+			var d delta
+			json.Unmarshal(fields["disk_content_delta"], &d)
+			if !reflect.DeepEqual(d, step.delta) {
+				t.Errorf("%s: delta = %+v, want %+v", step.name, d, step.delta)
+			}
+		}
+	}
+}
+
+func TestAdvertiserVersions(t *testing.T) {
+	viper.Set("Advertise.Deltas", true)
+	viper.Set("Advertise.SnapshotEvery", 1)
+	viper.Set("Advertise.SnapshotInterval", time.Hour)
+	viper.Set("Advertise.Filter", filterOff)
+	defer viper.Reset()
+
+	_, p2p := newFakeGateway(t)
+	a := newAdvertiser()
+	if a.currentVersion() != 0 {
+		t.Fatal("unpublished content shouldn't have a version")
+	}
+
+	last := uint64(0)
+	for i, content := range [][]string{{"site/a"}, {"site/a", "site/b"}, {"site/b"}} {
+		if err := a.publish(p2p, content); err != nil {
+			t.Fatal(err)
+		}
+		v := a.currentVersion()
+		if v <= last {
+			t.Fatalf("publish %d: version %d didn't go up from %d", i, v, last)
+		}
+		last = v
+	}
+}
+
+func TestAdvertiserFilter(t *testing.T) {
+	viper.Set("Advertise.Deltas", true)
+	viper.Set("Advertise.SnapshotEvery", 50)
+	viper.Set("Advertise.SnapshotInterval", time.Hour)
+	viper.Set("Advertise.Filter", filterOnly)
+	viper.Set("Advertise.FilterFalsePositiveRate", 0.01)
+	defer viper.Reset()
+
+	g, p2p := newFakeGateway(t)
+	a := newAdvertiser()
+	steps := []struct {
+		name      string
+		supported bool
+		want      []string
+	}{
+		{"gateway without filter support gets the list", false, []string{"disk_content", "disk_content_filter", "disk_content_version"}},
+		{"gateway with filter support only gets the filter", true, []string{"disk_content_filter", "disk_content_version"}},
+	}
+	for _, step := range steps {
+		a.setFilterSupported(step.supported)
+		if err := a.publish(p2p, []string{"site/a"}); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0)
+		for field := range g.last() {
+			got = append(got, field)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: published %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestGetNeeded(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      uint64
+		knowsVersion bool
+		want         []string
+	}{
+		{"never published", 0, true, []string{"site/from-list"}},
+		{"known version", 7, true, []string{"site/from-version"}},
+		{"unknown version", 7, false, []string{"site/from-list"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			if tt.version > 0 {
+				s.ads.version = tt.version
+				s.ads.published = true
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Version *uint64 `json:"content_version"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				switch {
+				case req.Version == nil:
+					w.Write([]byte(`{"success": true, "response": ["site/from-list"], "filter_supported": true}`))
+				case *req.Version == tt.version && tt.knowsVersion:
+					w.Write([]byte(`{"success": true, "response": ["site/from-version"]}`))
+				default:
+					w.Write([]byte(`{"success": false, "message": "unknown version"}`))
+				}
+			}))
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			viper.Set("NetworkGatewayProtocol", "http")
+			viper.Set("NetworkGatewayHostname", host)
+			viper.Set("NetworkGatewayPort", port)
+
+			if got := s.getNeeded(context.Background()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("needed = %v, want %v", got, tt.want)
+			}
+			// Only the full list answer says the gateway supports filters
+			if s.ads.filterSupported != (tt.want[0] == "site/from-list") {
+				t.Errorf("filter supported = %v", s.ads.filterSupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"encoding/base64"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilterVersion is bumped whenever the layout or hashing of the filter
+// changes so readers know how to check membership
+const bloomFilterVersion = 1
+
+// bloomFilter is a compact probabilistic set of our content. Bit positions are
+// derived from the 64 bit FNV-1a hash of the content name, split into two 32
+// bit halves h1 and h2 (forced odd), as (h1 + i*h2) mod bits for i in
+// [0, hashes).
+type bloomFilter struct {
+	bits []byte
+	m    uint64
+	k    uint64
+	n    int
+}
+
+// newBloomFilter sizes a filter for n entries at the target false positive
+// rate, never using more than maxBytes (which raises the actual rate)
+func newBloomFilter(n int, fpRate float64, maxBytes int) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if maxBytes > 0 && m > uint64(maxBytes)*8 {
+		m = uint64(maxBytes) * 8
+	}
+	// Round up to whole bytes
+	m = (m + 7) / 8 * 8
+	if m == 0 {
+		m = 8
+	}
+
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{bits: make([]byte, m/8), m: m, k: k}
+}
+
+func bloomHashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	// Make sure the second hash is odd so we never step by zero
+	return sum & 0xFFFFFFFF, (sum >> 32) | 1
+}
+
+func (b *bloomFilter) add(s string) {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % b.m
+		b.bits[pos/8] |= 1 << (pos % 8)
+	}
+	b.n++
+}
+
+// estimatedFalsePositiveRate is the expected rate for the entries added so far
+func (b *bloomFilter) estimatedFalsePositiveRate() float64 {
+	return math.Pow(1-math.Exp(-float64(b.k)*float64(b.n)/float64(b.m)), float64(b.k))
+}
+
+// advertisement is the filter in the form we publish in our node state
+func (b *bloomFilter) advertisement(contentVersion uint64) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                "bloom",
+		"version":             bloomFilterVersion,
+		"hash":                "fnv1a64-double",
+		"bits":                b.m,
+		"hashes":              b.k,
+		"count":               b.n,
+		"false_positive_rate": b.estimatedFalsePositiveRate(),
+		"content_version":     contentVersion,
+		"data":                base64.StdEncoding.EncodeToString(b.bits),
+	}
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+)
+
+// mayContain checks membership the way the layout is documented for readers
+func mayContain(bits []byte, m, k uint64, s string) bool {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < k; i++ {
+		pos := (h1 + i*h2) % m
+		if bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBloomFilterSizing(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		fpRate   float64
+		maxBytes int
+		wantBits uint64
+		wantK    uint64
+	}{
+		{"1% for 1000", 1000, 0.01, 0, 9592, 7},
+		{"capped by max bytes", 1000, 0.01, 100, 800, 1},
+		{"no entries", 0, 0.01, 0, 16, 11},
+		{"invalid rate uses 1%", 1000, 2, 0, 9592, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newBloomFilter(tt.n, tt.fpRate, tt.maxBytes)
+			if f.m != tt.wantBits || f.k != tt.wantK {
+				t.Errorf("bits = %d, hashes = %d, want %d, %d", f.m, f.k, tt.wantBits, tt.wantK)
+			}
+			if uint64(len(f.bits))*8 != f.m {
+				t.Errorf("%d bytes for %d bits", len(f.bits), f.m)
+			}
+		})
+	}
+}
+
+// contentName is a content name like the ones we advertise, assets are
+// named after their hash
+func contentName(website string, i int) string {
+	return website + "/" + hashName([]byte(strconv.Itoa(i)))
+}
+
+func TestBloomFilterMembership(t *testing.T) {
+	const n = 2000
+	f := newBloomFilter(n, 0.01, 0)
+	for i := 0; i < n; i++ {
+		f.add(contentName("site", i))
+	}
+
+	ad := f.advertisement(42)
+	bits, err := base64.StdEncoding.DecodeString(ad["data"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, k := ad["bits"].(uint64), ad["hashes"].(uint64)
+	if ad["count"].(int) != n || ad["content_version"].(uint64) != 42 {
+		t.Fatalf("advertisement = %v", ad)
+	}
+
+	// Everything we added is found, no false negatives
+	for i := 0; i < n; i++ {
+		if !mayContain(bits, m, k, contentName("site", i)) {
+			t.Fatalf("%s not found", contentName("site", i))
+		}
+	}
+
+	// Anything else is rarely found, allow some slack over the target rate
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if mayContain(bits, m, k, contentName("other", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.02 {
+		t.Errorf("false positive rate %.4f, want about 0.01", rate)
+	}
+	if est := f.estimatedFalsePositiveRate(); est < 0.005 || est > 0.02 {
+		t.Errorf("estimated false positive rate %.4f, want about 0.01", est)
+	}
+}
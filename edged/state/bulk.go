@@ -0,0 +1,288 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gladiusio/gladius-edged/edged/snapshot"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// errBulkUnsupported is returned when a peer doesn't serve bulk archives
+var errBulkUnsupported = errors.New("peer doesn't support bulk downloads")
+
+// bulkLimits remembers the peers that don't serve bulk archives, so we only
+// try them once, and caps how many archives we serve at a time
+type bulkLimits struct {
+	mux         sync.Mutex
+	unsupported map[string]bool
+	serving     int
+}
+
+func newBulkLimits() *bulkLimits {
+	return &bulkLimits{unsupported: make(map[string]bool)}
+}
+
+func (b *bulkLimits) supports(peer string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return !b.unsupported[peer]
+}
+
+func (b *bulkLimits) markUnsupported(peer string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.unsupported[peer] = true
+}
+
+// ServeBulk takes one of the Bulk.MaxConcurrent slots for serving an archive,
+// returning false if they are all in use. The returned func gives it back.
+func (s *State) ServeBulk() (func(), bool) {
+	b := s.bulk
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if max := viper.GetInt("Bulk.MaxConcurrent"); max > 0 && b.serving >= max {
+		return nil, false
+	}
+	b.serving++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mux.Lock()
+			b.serving--
+			b.mux.Unlock()
+		})
+	}, true
+}
+
+// WriteBulk streams a website (or the requested content if website is empty)
+// as a zstd compressed archive, so a peer can bootstrap from us in one request.
+// Assets are read from disk as they are written. Content we don't have, or
+// that is removed before we get to it, is left out of the archive.
+func (s *State) WriteBulk(w io.Writer, website string, contentNames []string) error {
+	contentDir, err := getContentDir()
+	if err != nil {
+		return err
+	}
+
+	m := snapshot.NewManifest()
+	added := make(map[string]bool)
+	s.mux.Lock()
+	if website != "" {
+		if wc := s.content.getWebsite(website); wc != nil {
+			for asset := range wc.assets {
+				contentNames = append(contentNames, strings.Join([]string{website, asset}, "/"))
+			}
+		}
+	}
+	for _, contentName := range contentNames {
+		if len(added) >= viper.GetInt("Bulk.MaxAssets") {
+			break
+		}
+		site, asset, ok := splitContentName(contentName)
+		if !ok || added[contentName] {
+			continue
+		}
+		wc := s.content.getWebsite(site)
+		if wc == nil || wc.getAsset(asset) == nil {
+			continue
+		}
+		added[contentName] = true
+		m.Websites[site] = append(m.Websites[site], snapshot.Asset{Name: asset, Size: wc.getAsset(asset).size, SHA256: strings.ToUpper(asset)})
+	}
+	s.mux.Unlock()
+
+	for site := range m.Websites {
+		assets := m.Websites[site]
+		sort.Slice(assets, func(i, j int) bool { return assets[i].Name < assets[j].Name })
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	err = snapshot.WriteArchiveFrom(zw, m, func(website, asset string) (io.ReadCloser, error) {
+		f, err := os.Open(filepath.Join(contentDir, website, asset))
+		if os.IsNotExist(err) {
+			return nil, snapshot.ErrSkipAsset
+		}
+		return f, err
+	})
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// peerBase returns the scheme and host of a content location
+func peerBase(location string) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// bestBulkPeer picks the peer that holds the most of the content we need, as
+// long as it holds enough of it to be worth a bulk download. Peers supports
+// returns false for are left out.
+func bestBulkPeer(locations []*networkContent, supports func(peer string) bool) (string, []string) {
+	byPeer := make(map[string][]string)
+	for _, nc := range locations {
+		seen := make(map[string]bool)
+		for _, location := range nc.contentLocations {
+			if base, ok := peerBase(location); ok && !seen[base] && supports(base) {
+				seen[base] = true
+				byPeer[base] = append(byPeer[base], nc.contentName)
+			}
+		}
+	}
+
+	best := ""
+	for base, content := range byPeer {
+		if best == "" || len(content) > len(byPeer[best]) {
+			best = base
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+
+	held := len(byPeer[best])
+	if held < viper.GetInt("Bulk.MinAssets") || float64(held) < viper.GetFloat64("Bulk.MinFraction")*float64(len(locations)) {
+		return "", nil
+	}
+	return best, byPeer[best]
+}
+
+// bulkDownload fetches everything the best peer has in one archive, each
+// asset is verified against its hash on its own and the ones we got are
+// returned. Anything missing is left to the per asset downloads.
+func (s *State) bulkDownload(ctx context.Context, locations []*networkContent) map[string]bool {
+	downloaded := make(map[string]bool)
+	if !viper.GetBool("Bulk.Enabled") {
+		return downloaded
+	}
+
+	peer, content := bestBulkPeer(locations, s.bulk.supports)
+	if peer == "" {
+		return downloaded
+	}
+
+	ctx, span := tracing.Start(ctx, "bulk_download", attribute.String("peer", peer), attribute.Int("content.requested", len(content)))
+	log.Info().Str("peer", peer).Int("assets", len(content)).Msg("Bootstrapping content from peer in bulk")
+	received, err := s.receiveBulk(ctx, peer, content)
+	span.SetAttributes(attribute.Int("content.received", len(received)))
+	tracing.End(span, err)
+	for _, contentName := range received {
+		downloaded[contentName] = true
+		s.fetches.record(sourcePeer, peer, nil)
+		s.markVerified(contentName)
+	}
+	if err == errBulkUnsupported {
+		// An older peer, don't ask it again
+		s.bulk.markUnsupported(peer)
+		log.Debug().Str("peer", peer).Msg("Peer doesn't support bulk downloads, falling back to single downloads")
+	} else if err != nil {
+		log.Warn().Err(err).Str("peer", peer).Int("received", len(received)).Msg("Error downloading content from peer in bulk")
+	} else {
+		log.Info().Str("peer", peer).Int("received", len(received)).Int("requested", len(content)).Msg("Finished bulk download from peer")
+	}
+	return downloaded
+}
+
+func (s *State) receiveBulk(ctx context.Context, peer string, content []string) ([]string, error) {
+	contentDir, err := getContentDir()
+	if err != nil {
+		return nil, err
+	}
+
+	requested := make(map[string]bool)
+	websites := make(map[string]bool)
+	for _, contentName := range content {
+		requested[contentName] = true
+		if website, _, ok := splitContentName(contentName); ok {
+			websites[website] = true
+		}
+	}
+	// Keep garbage collection from removing the directories we write to
+	for website := range websites {
+		s.websites.acquire(website)
+		defer s.websites.release(website)
+	}
+
+	c := &contentList{Content: content}
+	client := &http.Client{Timeout: viper.GetDuration("Bulk.Timeout")}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/bulk", bytes.NewBufferString(c.Marshal()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errBulkUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer responded with status %d", resp.StatusCode)
+	}
+
+	reserved := make([]string, 0)
+	received, err := snapshot.Receive(resp.Body, contentDir, func(website, asset string, size int64) error {
+		contentName := strings.Join([]string{website, asset}, "/")
+		if !requested[contentName] {
+			return errors.New("peer sent content we didn't ask for")
+		}
+		if s.tombstones.isTombstoned(contentName) {
+			return errors.New("content has been removed")
+		}
+		if err := s.makeRoom(website, asset, size); err != nil {
+			return err
+		}
+		reserved = append(reserved, contentName)
+		return nil
+	})
+
+	// Give back the room of anything that didn't make it to disk
+	for _, contentName := range reserved {
+		if website, asset, ok := splitContentName(contentName); ok {
+			s.unreserve(website, asset)
+		}
+	}
+	return received, err
+}
+
+// bulkRequest is the body of a bulk request from a peer
+type bulkRequest struct {
+	Content []string `json:"content"`
+}
+
+// ParseBulkRequest reads the content names from a bulk request body
+func ParseBulkRequest(body []byte) ([]string, error) {
+	r := &bulkRequest{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, err
+	}
+	return r.Content, nil
+}
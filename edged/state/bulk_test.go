@@ -0,0 +1,169 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gladiusio/gladius-edged/edged/snapshot"
+	"github.com/spf13/viper"
+)
+
+// testLocations returns content held by each peer, count assets per peer
+func testLocations(peers map[string]int) []*networkContent {
+	locations := make([]*networkContent, 0)
+	for peer, count := range peers {
+		for i := 0; i < count; i++ {
+			locations = append(locations, &networkContent{
+				contentName:      fmt.Sprintf("site/%s-%d", peer, i),
+				contentLocations: []string{"http://" + peer + "/content?website=site"},
+			})
+		}
+	}
+	return locations
+}
+
+func TestBestBulkPeer(t *testing.T) {
+	tests := []struct {
+		name        string
+		peers       map[string]int
+		minFraction float64
+		unsupported string
+		want        string
+	}{
+		{"most content", map[string]int{"a:8080": 30, "b:8080": 5}, 0.5, "", "http://a:8080"},
+		{"not enough content", map[string]int{"a:8080": 10}, 0.5, "", ""},
+		{"not enough of what we need", map[string]int{"a:8080": 25, "b:8080": 25, "c:8080": 25}, 0.5, "", ""},
+		{"unsupported peer is skipped", map[string]int{"a:8080": 40, "b:8080": 45}, 0.4, "http://b:8080", "http://a:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set("Bulk.MinAssets", 20)
+			viper.Set("Bulk.MinFraction", tt.minFraction)
+			supports := func(peer string) bool { return peer != tt.unsupported }
+
+			got, content := bestBulkPeer(testLocations(tt.peers), supports)
+			if got != tt.want {
+				t.Errorf("peer = %q, want %q", got, tt.want)
+			}
+			if got != "" && len(content) < 20 {
+				t.Errorf("only %d assets for the best peer", len(content))
+			}
+		})
+	}
+}
+
+func TestWriteBulk(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Bulk.MaxAssets", 10)
+	a := addTestAsset(t, s, "site", []byte("a"))
+	b := addTestAsset(t, s, "other", []byte("b"))
+	// Known, but removed from disk before the archive got to it
+	c := addTestAsset(t, s, "gone", []byte("c"))
+	contentDir, err := getContentDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(contentDir, "gone", c)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := s.WriteBulk(buf, "", []string{"site/" + a, "other/" + b, "gone/" + c, "missing/" + hashName([]byte("d"))}); err != nil {
+		t.Fatalf("WriteBulk() err = %v", err)
+	}
+
+	dir := t.TempDir()
+	received, err := snapshot.Receive(buf, dir, func(website, asset string, size int64) error { return nil })
+	if err != nil {
+		t.Fatalf("Receive() err = %v", err)
+	}
+	want := []string{"other/" + b, "site/" + a}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("received = %v, want %v", received, want)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dir, "site", a)); err != nil || string(got) != "a" {
+		t.Errorf("stored asset = %q, err = %v", got, err)
+	}
+}
+
+func TestParseBulkRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{"content list", `{"content": ["site/a", "site/b"]}`, []string{"site/a", "site/b"}, false},
+		{"invalid body", `{`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBulkRequest([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("content = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBulkDownloadUnsupported(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Bulk.Enabled", true)
+	viper.Set("Bulk.MinAssets", 1)
+
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer peer.Close()
+
+	locations := []*networkContent{{contentName: "site/" + hashName([]byte("a")), contentLocations: []string{peer.URL + "/content"}}}
+	for i := 0; i < 3; i++ {
+		if got := s.bulkDownload(context.Background(), locations); len(got) != 0 {
+			t.Fatalf("downloaded %v from a peer without bulk support", got)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("asked the peer %d times, want once", requests)
+	}
+}
+
+func TestServeBulk(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Bulk.MaxConcurrent", 2)
+
+	first, ok := s.ServeBulk()
+	if !ok {
+		t.Fatal("first request refused")
+	}
+	if _, ok := s.ServeBulk(); !ok {
+		t.Fatal("second request refused")
+	}
+	if _, ok := s.ServeBulk(); ok {
+		t.Fatal("served more than Bulk.MaxConcurrent at a time")
+	}
+
+	// Giving a slot back twice only frees it once
+	first()
+	first()
+	if _, ok := s.ServeBulk(); !ok {
+		t.Fatal("request refused after a slot was freed")
+	}
+	if _, ok := s.ServeBulk(); ok {
+		t.Fatal("a slot was freed twice")
+	}
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -12,12 +13,26 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// reloadDelay is how long we wait for more changes before reloading content
+const reloadDelay = time.Second
+
+// ignoredName returns true for what isn't content in the content directory,
+// the temp files of downloads and the hidden directories imports are staged in
+func ignoredName(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "_temp")
+}
+
 func (s *State) startContentFileWatcher() {
 	// creates a new file watcher
 	watcher, err := fsnotify.NewWatcher()
@@ -26,6 +41,27 @@ func (s *State) startContentFileWatcher() {
 		defer watcher.Close()
 	}
 	done := make(chan bool)
+
+	// Reload once a burst of new files (a sync round or an import) settles
+	// down instead of once for every file
+	reloads := make(chan struct{}, 1)
+	go func() {
+		for range reloads {
+			time.Sleep(reloadDelay)
+			select {
+			case <-reloads:
+			default:
+			}
+			s.loadContentFromDisk()
+		}
+	}()
+	reload := func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	}
+
 	go func() {
 		for {
 			select {
@@ -34,7 +70,7 @@ func (s *State) startContentFileWatcher() {
 				if event.Op&fsnotify.Create == fsnotify.Create ||
 					event.Op&fsnotify.Remove == fsnotify.Remove ||
 					event.Op&fsnotify.Rename == fsnotify.Rename {
-					if !strings.Contains(event.Name, "temp") {
+					if !ignoredName(filepath.Base(event.Name)) {
 						// Get some info about the file (if it exists)
 						fi, fErr := os.Stat(event.Name)
 						if fErr == nil {
@@ -45,8 +81,10 @@ func (s *State) startContentFileWatcher() {
 										Str("directory", event.Name).
 										Msg("Can't add watcher to website directory")
 								}
+								// Whole websites can be moved in (by an import)
+								reload()
 							} else {
-								s.loadContentFromDisk()
+								reload()
 							}
 						}
 					}
@@ -80,7 +118,7 @@ func (s *State) startContentFileWatcher() {
 	}
 	for _, f := range files {
 		website := f.Name()
-		if f.IsDir() {
+		if f.IsDir() && !ignoredName(website) {
 			if err := watcher.Add(path.Join(filePath, website)); err != nil {
 				log.Error().
 					Err(err).
@@ -93,8 +131,14 @@ func (s *State) startContentFileWatcher() {
 	<-done
 }
 
-// LoadContentFromDisk loads the content from the disk and stores it in the state
+// LoadContentFromDisk loads the content from the disk and stores it in the
+// state. Only assets that are new or changed since they were indexed are read
+// and verified, the rest are loaded when first requested if lazy loading is on.
 func (s *State) loadContentFromDisk() {
+	// The file watcher and a rescan from the admin API can overlap
+	s.scans.Lock()
+	defer s.scans.Unlock()
+
 	filePath, err := getContentDir()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error getting content dir")
@@ -107,9 +151,16 @@ func (s *State) loadContentFromDisk() {
 	// map websites
 	cs := &contentStore{make(map[string]*websiteContent)}
 
+	lazy := viper.GetBool("Index.LazyLoad")
+	indexed := s.index.load()
+	changed := make(map[string]*indexEntry)
+	seen := make(map[string]bool)
+	// What we know of every asset on disk, to seed eviction order with
+	entries := make(map[string]*indexEntry)
+
 	for _, f := range files {
 		website := f.Name()
-		if f.IsDir() {
+		if f.IsDir() && !ignoredName(website) {
 			// Create a website store
 			wc := cs.createWebsite(website)
 
@@ -123,52 +174,160 @@ func (s *State) loadContentFromDisk() {
 
 			for _, websiteFile := range websiteFiles {
 				// Ignore subdirecories
-				if !websiteFile.IsDir() && !strings.Contains(websiteFile.Name(), "temp") {
+				if !websiteFile.IsDir() && !ignoredName(websiteFile.Name()) {
 					fileName := websiteFile.Name()
+					contentName := strings.Join([]string{website, fileName}, "/")
+
+					// Content that was removed can still arrive from stale peers
+					if s.tombstones.isTombstoned(contentName) {
+						os.Remove(path.Join(filePath, website, fileName))
+						continue
+					}
+
+					// New or changed since it was indexed, so it has to be verified
+					e, ok := indexed[contentName]
+					if !ok || !e.matches(websiteFile) {
+						ne := &indexEntry{Size: websiteFile.Size(), ModTime: websiteFile.ModTime(), FirstSeen: time.Now()}
+						if ok {
+							ne.FirstSeen, ne.LastAccess, ne.Hits = e.FirstSeen, e.LastAccess, e.Hits
+						}
+						e = ne
+						changed[contentName] = e
+					}
+					entries[contentName] = e
+
+					if e.Verified {
+						// Don't read what we already have in memory again
+						if b := s.loadedAsset(website, fileName); b != nil && int64(len(b)) == e.Size {
+							wc.createAsset(fileName, e.Size, b)
+							seen[contentName] = true
+							continue
+						}
+						if lazy {
+							wc.createAsset(fileName, e.Size, nil)
+							seen[contentName] = true
+							continue
+						}
+					}
 
 					// Pull the file
-					b, err := ioutil.ReadFile(path.Join(filePath, website, fileName))
+					b, verified, err := s.readAsset(website, fileName, e)
+					delete(changed, contentName)
 					if err != nil {
 						log.Warn().
 							Str("file_name", fileName).
 							Err(err).
 							Msg("Error loading asset")
+						if !verified {
+							os.Remove(path.Join(filePath, website, fileName))
+						}
 						continue
 					}
 					// Create the asset in the website content
-					wc.createAsset(fileName, []byte(b))
+					wc.createAsset(fileName, int64(len(b)), b)
+					seen[contentName] = true
 					log.Debug().Str("asset_name", fileName).Msg("Loaded new asset")
 				}
 			}
 		}
 	}
+
+	// Bring the index in line with what is on disk
+	s.index.put(changed)
+	missing := make([]string, 0)
+	for contentName := range indexed {
+		if !seen[contentName] {
+			missing = append(missing, contentName)
+		}
+	}
+	s.index.remove(missing...)
+	for contentName := range entries {
+		if !seen[contentName] {
+			delete(entries, contentName)
+		}
+	}
+	s.storage.seed(entries)
+
+	atomic.StoreInt32(&s.scanned, 1)
+
 	go func() {
 		// Wait until we have joined the network before we try to update our content
 		s.p2p.BlockUntilJoined()
 
 		s.mux.Lock()
 		s.content = cs
+		s.websitesChanged()
+		s.mux.Unlock()
+		s.advertiseContent()
+	}()
+}
+
+// advertiseContent tells the network about the content we have now, used
+// when content is removed as the file watcher only picks up new files. It
+// only queues the update so it can be called with the lock held, several
+// changes at once are published together.
+func (s *State) advertiseContent() {
+	select {
+	case s.publishes <- struct{}{}:
+	default:
+	}
+}
+
+// startPublisher publishes our content whenever it changes, one update at a
+// time so an older list can never be published over a newer one. The list is
+// copied under the lock and published without it, so serving doesn't wait
+// on the gateway.
+func (s *State) startPublisher() {
+	s.p2p.BlockUntilJoined()
+	for range s.publishes {
+		s.publishUnlessLeft()
+	}
+}
 
-		// Tell the controld about our new content
-		err = s.p2p.UpdateField("disk_content", cs.getContentList()...)
+// publishUnlessLeft publishes our content unless we were told to leave, then
+// the network shouldn't hear from us. The next publish once we join again is
+// a full snapshot.
+func (s *State) publishUnlessLeft() {
+	if s.p2p.Left() {
+		s.ads.requestSnapshot()
+		return
+	}
+	s.publishContent()
+}
+
+// RepublishContent tells the network about all of our content, like after
+// joining it again
+func (s *State) RepublishContent() {
+	s.ads.requestSnapshot()
+	s.advertiseContent()
+}
+
+// publishContent tells the controld about our content
+func (s *State) publishContent() {
+	err := s.ads.publish(s.p2p, s.getContentList())
+	if err != nil {
+		log.Warn().Err(err).Msg("Error updating disk content, trying again in a few seconds")
+		time.Sleep(2 * time.Second)
+		err = s.ads.publish(s.p2p, s.getContentList())
 		if err != nil {
-			log.Warn().Err(err).Msg("Error updating disk content, trying again in a few seconds")
-			time.Sleep(2 * time.Second)
-			err = s.p2p.UpdateField("disk_content", cs.getContentList()...)
-			if err != nil {
-				log.Warn().Err(err).Msg("Error retrying updating disk content, not trying again.")
-			} else {
-				log.Info().Msg("Second disk content update worked!")
-			}
+			log.Warn().Err(err).Msg("Error retrying updating disk content, not trying again.")
+		} else {
+			log.Info().Msg("Second disk content update worked!")
 		}
-		s.mux.Unlock()
-	}()
+	}
 }
 
 func (s *State) startContentSyncWatcher() {
 	// Get the files we have on disk now
 	s.loadContentFromDisk()
 	go s.startContentFileWatcher()
+	go s.startPublisher()
+	go s.startIndexFlusher()
+	go s.startStatsFlusher()
+	go s.startTimeSeries()
+	go s.startSnapshotTicker()
+	go s.startGarbageCollector()
+	go s.pulls.startSweeper()
 
 	/* If there is new content we need, sleep for a random time then ask which
 	nodes have it in the network, then download it from a random one. This allows
@@ -176,52 +335,224 @@ func (s *State) startContentSyncWatcher() {
 	go func() {
 		// Wait until we have joined the p2p network
 		s.p2p.BlockUntilJoined()
+
+		// The gateway tells us when we need something, polling is only a fallback
+		// for when we aren't subscribed
+		sub := newGatewaySubscription()
+		if viper.GetBool("Sync.Subscribe") {
+			go sub.run()
+		}
+		// Tombstones are applied as they arrive, a long sync round mustn't hold
+		// up the subscription
+		go func() {
+			for directives := range sub.tombstones {
+				s.applyTombstones(directives)
+			}
+		}()
+
 		for {
-			time.Sleep(2 * time.Second)       // Sleep to give the controld a break
-			siteContent := s.getContentList() // Fetch what we have on disk in a format that's understood by the controld
-			contentNeeded := getNeededFromControld(siteContent)
-
-			if len(contentNeeded) > 0 {
-				r := rand.New(rand.NewSource(time.Now().Unix()))
-				time.Sleep(time.Duration(r.Intn(10)) * time.Second) // Random sleep allow better propogation
-
-				for _, nc := range getContentLocationsFromControld(contentNeeded) {
-					if len(nc.contentLocations) > 0 {
-						contentLocations := nc.contentLocations
-						contentName := nc.contentName
-
-						contentDir, err := getContentDir()
-						if err != nil {
-							log.Fatal().Err(err).Msg("Can't find content dir")
-							return
-						}
+			pollInterval := viper.GetDuration("Sync.PollInterval")
+			if sub.isConnected() {
+				pollInterval = viper.GetDuration("Sync.FallbackPollInterval")
+			}
 
-						contentURL := contentLocations[r.Intn(len(contentLocations))]
-						log.Debug().Str("url", contentURL).Msg("Downloading file from peer")
-
-						// Create a filepath location from the content name
-						toDownload := filepath.Join(append([]string{contentDir}, strings.Split(contentName, "/")...)...)
-
-						// Pass in the name so we can verify the hash (filename is the hash)
-						err = downloadFile(toDownload, contentURL, strings.Split(contentName, "/")[1])
-						if err != nil {
-							log.Warn().
-								Str("url", contentURL).
-								Str("filename", contentName).
-								Str("path", toDownload).
-								Err(err).
-								Msg("Error downloading file from peer")
-						}
-					}
+			// Notifications that arrive while paused are dropped, the round run
+			// on resume catches up
+			select {
+			case <-time.After(pollInterval): // Sleep to give the controld a break
+				if !s.syncing.isPaused() {
+					s.syncRound(nil)
+				}
+			case <-s.syncing.trigger:
+				if !s.syncing.isPaused() {
+					s.syncRound(nil)
+				}
+			case <-sub.changed:
+				// Anything pushed while we were disconnected was missed, so ask
+				// for it now. On a disconnect we go back to polling often.
+				if sub.isConnected() && !s.syncing.isPaused() {
+					s.syncRound(nil)
+				}
+			case contentNeeded := <-sub.notifications:
+				if !s.syncing.isPaused() {
+					s.syncRound(contentNeeded)
 				}
 			}
 		}
 	}()
 }
 
+// syncRound asks the controld what we need (unless a notification already
+// told us) and downloads it, traced as a single round
+func (s *State) syncRound(contentNeeded []string) {
+	ctx, span := tracing.Start(context.Background(), "sync_round")
+	defer span.End()
+
+	// Some notifications just tell us something changed, so ask what
+	if len(contentNeeded) == 0 {
+		contentNeeded = s.getNeeded(ctx)
+	}
+	span.SetAttributes(attribute.Int("content.needed", len(contentNeeded)))
+	s.syncContent(ctx, contentNeeded)
+}
+
+// syncContent downloads the content we need, first from our parent, then from
+// a peer that has most of it in bulk, then from a random peer that has it, and
+// finally from the website's origin
+func (s *State) syncContent(ctx context.Context, contentNeeded []string) {
+	// Pinned content is fetched first
+	contentNeeded = s.prioritizePins(contentNeeded)
+
+	// Leave anything we just evicted alone for a while, and anything removed
+	// for good until its tombstone expires
+	wanted := make([]string, 0, len(contentNeeded))
+	for _, contentName := range contentNeeded {
+		if !s.storage.recentlyEvicted(contentName) && !s.tombstones.isTombstoned(contentName) {
+			wanted = append(wanted, contentName)
+		}
+	}
+	contentNeeded = wanted
+	if len(contentNeeded) == 0 {
+		return
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	time.Sleep(time.Duration(r.Intn(10)) * time.Second) // Random sleep allow better propogation
+
+	downloaded := make(map[string]bool)
+	queued := func() {
+		s.setQueueDepth(int64(len(contentNeeded) - len(downloaded)))
+	}
+	queued()
+	defer s.setQueueDepth(0)
+
+	// Our parent edge gets the first chance to give us what we need
+	fromPeers := make([]string, 0, len(contentNeeded))
+	for _, contentName := range contentNeeded {
+		website, asset, ok := splitContentName(contentName)
+		if ok {
+			if parentURL, ok := getParentURL(website, asset); ok {
+				if s.downloadContent(ctx, contentName, parentURL, sourceParent) == nil {
+					downloaded[contentName] = true
+					queued()
+					continue
+				}
+			}
+		}
+		fromPeers = append(fromPeers, contentName)
+	}
+
+	if len(fromPeers) == 0 {
+		return
+	}
+	locations := getContentLocationsFromControld(ctx, fromPeers)
+	// If one peer has most of what we need get it all in one go
+	for contentName := range s.bulkDownload(ctx, locations) {
+		downloaded[contentName] = true
+	}
+	queued()
+	for _, nc := range locations {
+		if len(nc.contentLocations) > 0 && !downloaded[nc.contentName] {
+			contentURL := nc.contentLocations[r.Intn(len(nc.contentLocations))]
+			if s.downloadContent(ctx, nc.contentName, contentURL, sourcePeer) == nil {
+				downloaded[nc.contentName] = true
+				queued()
+			}
+		}
+	}
+
+	// Anything no peer could give us can come from the website's origin (if it has one)
+	for _, contentName := range fromPeers {
+		if downloaded[contentName] {
+			continue
+		}
+		website, asset, ok := splitContentName(contentName)
+		if !ok {
+			continue
+		}
+		if originURL, ok := getOriginURL(website, asset); ok {
+			s.downloadContent(ctx, contentName, originURL, sourceOrigin)
+		}
+		// Done with it either way
+		downloaded[contentName] = true
+		queued()
+	}
+}
+
+// downloadContent downloads the named content (<website name>/<fileName>) from
+// the url into the content directory and records where it came from
+func (s *State) downloadContent(ctx context.Context, contentName, contentURL, source string) (err error) {
+	ctx, span := tracing.Start(ctx, "download",
+		attribute.String("content.name", contentName),
+		attribute.String("content.source", source),
+		attribute.String("url.full", contentURL),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	atomic.AddInt64(&s.downloading, 1)
+	defer atomic.AddInt64(&s.downloading, -1)
+
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return errors.New("invalid content name: " + contentName)
+	}
+
+	contentDir, err := getContentDir()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Can't find content dir")
+		return err
+	}
+
+	log.Debug().Str("url", contentURL).Str("source", source).Msg("Downloading file from " + source)
+
+	// Create a filepath location from the content name
+	toDownload := filepath.Join(contentDir, website, asset)
+
+	// Keep garbage collection from removing the website's directory under us
+	s.websites.acquire(website)
+	defer s.websites.release(website)
+
+	// Pass in the name so we can verify the hash (filename is the hash)
+	err = downloadFile(ctx, toDownload, contentURL, asset, func(size int64) error {
+		return s.makeRoom(website, asset, size)
+	})
+	s.fetches.record(source, contentURL, err)
+	if err != nil {
+		s.unreserve(website, asset)
+		log.Warn().
+			Str("url", contentURL).
+			Str("filename", contentName).
+			Str("path", toDownload).
+			Str("source", source).
+			Err(err).
+			Msg("Error downloading file from " + source)
+		return err
+	}
+	s.markVerified(contentName)
+	if source == sourceOrigin {
+		log.Info().
+			Str("url", contentURL).
+			Str("filename", contentName).
+			Msg("Fetched asset from the website origin")
+	}
+	return nil
+}
+
+// splitContentName splits a content name in the format <website name>/<fileName>
+func splitContentName(contentName string) (string, string, bool) {
+	parts := strings.Split(contentName, "/")
+	if len(parts) != 2 || !validContentName(parts[0]) || !validContentName(parts[1]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
 // downloadFile will download a url to a local file. It's efficient because it will
-// write as it downloads and not load the whole file into memory.
-func downloadFile(toDownload, url, name string) error {
+// write as it downloads and not load the whole file into memory. reserve is
+// called to make room for the file with the size the server claims before
+// downloading, and again with the actual size once the hash is verified if
+// they differ.
+func downloadFile(ctx context.Context, toDownload, url, name string, reserve func(size int64) error) error {
 	err := os.MkdirAll(filepath.Dir(toDownload), os.ModePerm)
 	if err != nil {
 		log.Fatal().Err(err)
@@ -233,18 +564,39 @@ func downloadFile(toDownload, url, name string) error {
 		return err
 	}
 
-	// Get the data
-	resp, err := http.Get(url)
+	// Get the data, passing on the trace so the peer can continue it
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	tracing.Inject(ctx, req.Header)
+	// A stalled parent or peer would hold up the whole sync round
+	resp, err := startDownload(req, viper.GetDuration("Sync.DownloadTimeout"))
 	if err != nil {
 		out.Close()
+		os.Remove(toDownload + "_temp")
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		out.Close()
+		os.Remove(toDownload + "_temp")
+		return errors.New("unexpected status: " + resp.Status)
+	}
+	if resp.ContentLength >= 0 {
+		if err := reserve(resp.ContentLength); err != nil {
+			out.Close()
+			os.Remove(toDownload + "_temp")
+			return err
+		}
+	}
 
 	// Write the body to file
 	_, err = io.Copy(out, resp.Body)
 	if err != nil {
 		out.Close()
+		os.Remove(toDownload + "_temp")
 		return err
 	}
 
@@ -262,19 +614,94 @@ func downloadFile(toDownload, url, name string) error {
 		return err
 	}
 
-	actualHash := fmt.Sprintf("%X", h.Sum(nil))
-	if actualHash != strings.ToUpper(name) {
-		out.Close()
-		//os.Remove(toDownload + "_temp")
-		errorString := fmt.Sprintf("incoming file from peer did not match expected hash. Expecting: %s, got: %s", strings.ToUpper(name), actualHash)
-		return errors.New(errorString)
+	if err := verifyHash(h.Sum(nil), name); err != nil {
+		f.Close()
+		os.Remove(toDownload + "_temp")
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != resp.ContentLength {
+		if err := reserve(fi.Size()); err != nil {
+			f.Close()
+			os.Remove(toDownload + "_temp")
+			return err
+		}
 	}
 
-	os.Rename(toDownload+"_temp", toDownload)
+	f.Close()
+	if err := os.Rename(toDownload+"_temp", toDownload); err != nil {
+		os.Remove(toDownload + "_temp")
+		return err
+	}
 	log.Debug().
 		Str("url", url).
 		Str("filename", name).
 		Str("path", toDownload).
-		Msg("A new file was downloaded from a peer")
+		Msg("A new file was downloaded")
+	return nil
+}
+
+// loadedAsset returns an asset if it's already in memory
+func (s *State) loadedAsset(website, asset string) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if wc := s.content.getWebsite(website); wc != nil {
+		if a := wc.getAsset(asset); a != nil {
+			return a.data
+		}
+	}
+	return nil
+}
+
+// readAsset reads an asset from disk, verifying its hash unless the index says
+// it's unchanged since it was last verified. verified is false if the asset
+// doesn't match its hash.
+func (s *State) readAsset(website, asset string, e *indexEntry) ([]byte, bool, error) {
+	contentDir, err := getContentDir()
+	if err != nil {
+		return nil, true, err
+	}
+	contentPath := filepath.Join(contentDir, website, asset)
+
+	fi, err := os.Stat(contentPath)
+	if err != nil {
+		return nil, true, err
+	}
+	b, err := ioutil.ReadFile(contentPath)
+	if err != nil {
+		return nil, true, err
+	}
+	if e != nil && e.Verified && e.matches(fi) {
+		return b, true, nil
+	}
+
+	sum := sha256.Sum256(b)
+	if err := verifyHash(sum[:], asset); err != nil {
+		return nil, false, err
+	}
+
+	if e == nil {
+		e = &indexEntry{FirstSeen: time.Now()}
+	}
+	e.Size = fi.Size()
+	e.ModTime = fi.ModTime()
+	e.Verified = true
+	s.index.put(map[string]*indexEntry{strings.Join([]string{website, asset}, "/"): e})
+	return b, true, nil
+}
+
+// verifyHash checks the sha256 sum of a file against its name (the name is the hash)
+func verifyHash(sum []byte, name string) error {
+	actualHash := fmt.Sprintf("%X", sum)
+	if actualHash != strings.ToUpper(name) {
+		metrics.HashMismatches.Inc()
+		errorString := fmt.Sprintf("incoming file from peer did not match expected hash. Expecting: %s, got: %s", strings.ToUpper(name), actualHash)
+		return errors.New(errorString)
+	}
 	return nil
 }
@@ -0,0 +1,195 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func hashName(b []byte) string {
+	return fmt.Sprintf("%X", sha256.Sum256(b))
+}
+
+func TestDownloadFile(t *testing.T) {
+	asset := []byte("some asset")
+	name := hashName(asset)
+
+	tests := []struct {
+		name         string
+		status       int
+		body         []byte
+		wantErr      bool
+		wantReserved int64
+	}{
+		{"matching hash", http.StatusOK, asset, false, int64(len(asset))},
+		// Room is made before downloading, the caller gives it back
+		{"hash mismatch", http.StatusOK, []byte("corrupt"), true, 7},
+		{"not found", http.StatusNotFound, nil, true, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			dir, err := ioutil.TempDir("", "edged-download")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			toDownload := filepath.Join(dir, "website", name)
+
+			reserved := int64(-1)
+			err = downloadFile(context.Background(), toDownload, server.URL, name, func(size int64) error {
+				reserved = size
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// Nothing is left behind when a download fails
+			if _, err := os.Stat(toDownload + "_temp"); !os.IsNotExist(err) {
+				t.Errorf("temp file left on disk: %v", err)
+			}
+			if reserved != tt.wantReserved {
+				t.Errorf("reserved %d, want %d", reserved, tt.wantReserved)
+			}
+			_, err = os.Stat(toDownload)
+			if tt.wantErr && !os.IsNotExist(err) {
+				t.Error("failed download was stored")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("download wasn't stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadFileNoRoom(t *testing.T) {
+	asset := []byte("some asset")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(asset)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "edged-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	toDownload := filepath.Join(dir, "website", hashName(asset))
+
+	err = downloadFile(context.Background(), toDownload, server.URL, hashName(asset), func(int64) error { return errors.New("no room") })
+	if err == nil {
+		t.Fatal("stored an asset there was no room for")
+	}
+	for _, name := range []string{toDownload, toDownload + "_temp"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s left on disk", name)
+		}
+	}
+}
+
+func TestVerifyHash(t *testing.T) {
+	sum := sha256.Sum256([]byte("asset"))
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{"upper case", fmt.Sprintf("%X", sum), false},
+		{"lower case", fmt.Sprintf("%x", sum), false},
+		{"other hash", hashName([]byte("other")), true},
+		{"not a hash", "index.html", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyHash(sum[:], tt.file); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadFileTimeout(t *testing.T) {
+	viper.Set("Sync.DownloadTimeout", 100*time.Millisecond)
+	defer viper.Reset()
+
+	// A peer that sends headers and then stalls
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dir, err := ioutil.TempDir("", "edged-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	toDownload := filepath.Join(dir, "website", hashName([]byte("asset")))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadFile(context.Background(), toDownload, server.URL, filepath.Base(toDownload), func(int64) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("stalled download succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled download didn't time out")
+	}
+	if _, err := os.Stat(toDownload + "_temp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left on disk: %v", err)
+	}
+}
+
+func TestLoadContentIgnoresStaging(t *testing.T) {
+	s := newTestState(t)
+	contentDir, _ := getContentDir()
+	asset := []byte("asset")
+	name := hashName(asset)
+
+	// A download in progress and an import being staged
+	files := map[string][]byte{
+		filepath.Join("site", name):                          asset,
+		filepath.Join("site", hashName([]byte("b"))+"_temp"): []byte("b"),
+		filepath.Join(".import123", "site", name):            asset,
+	}
+	for f, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(contentDir, f)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(contentDir, f), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The content is only swapped in once we are in the network, but what
+	// the scan found is seeded for eviction right away
+	s.loadContentFromDisk()
+	s.storage.mux.Lock()
+	defer s.storage.mux.Unlock()
+	if len(s.storage.access) != 1 || s.storage.access["site/"+name] == nil {
+		t.Errorf("scanned %v, want only site/%s", s.storage.access, name)
+	}
+}
@@ -0,0 +1,76 @@
+package state
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Downloads share connections with others that have the same timeout
+var (
+	downloadTransportsMux sync.Mutex
+	downloadTransports    = make(map[time.Duration]*http.Transport)
+)
+
+func downloadTransport(timeout time.Duration) *http.Transport {
+	downloadTransportsMux.Lock()
+	defer downloadTransportsMux.Unlock()
+
+	t, ok := downloadTransports[timeout]
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = timeout
+		downloadTransports[timeout] = t
+	}
+	return t
+}
+
+// startDownload sends a download request. A server that takes longer than
+// the timeout to answer, or stops sending the body for that long, is given up
+// on, but a large download that keeps making progress can take as long as it
+// needs. A timeout of 0 waits forever. The caller must close the body.
+func startDownload(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return http.DefaultClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	client := &http.Client{Transport: downloadTransport(timeout)}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleBody{
+		ReadCloser: resp.Body,
+		timeout:    timeout,
+		timer:      time.AfterFunc(timeout, cancel),
+		cancel:     cancel,
+	}
+	return resp, nil
+}
+
+// idleBody cancels a download when no data arrives for the timeout, the
+// deadline resets whenever some does
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStartDownload(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   func(w http.ResponseWriter, release chan struct{})
+		want    string
+		wantErr bool
+	}{
+		{"doesn't answer", func(w http.ResponseWriter, release chan struct{}) {
+			<-release
+		}, "", true},
+		{"stalls mid download", func(w http.ResponseWriter, release chan struct{}) {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+		}, "partial", true},
+		{"slow but steady", func(w http.ResponseWriter, release chan struct{}) {
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("a"))
+				w.(http.Flusher).Flush()
+				time.Sleep(30 * time.Millisecond)
+			}
+		}, "aaaaaaaaaa", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.serve(w, release)
+			}))
+			defer server.Close()
+			defer close(release)
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b []byte
+			resp, err := startDownload(req, 100*time.Millisecond)
+			if err == nil {
+				b, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(b) != tt.want {
+				t.Errorf("downloaded %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// wantedContent is the content the network (or the manifest) wants us to hold,
+// entire websites or single assets in the format <website name>/<fileName>
+type wantedContent struct {
+	Websites []string `json:"websites"`
+	Content  []string `json:"content"`
+}
+
+// wantsWebsite returns true if the website, or any asset of it, is wanted
+func (w *wantedContent) wantsWebsite(website string) bool {
+	for _, ws := range w.Websites {
+		if ws == website {
+			return true
+		}
+	}
+	for _, c := range w.Content {
+		if strings.HasPrefix(c, website+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *wantedContent) wants(contentName string) bool {
+	website, _, _ := splitContentName(contentName)
+	for _, ws := range w.Websites {
+		if ws == website {
+			return true
+		}
+	}
+	for _, c := range w.Content {
+		if c == contentName {
+			return true
+		}
+	}
+	return false
+}
+
+// gcReport is the outcome of a garbage collection pass
+type gcReport struct {
+	DryRun   bool
+	Removed  []string
+	Pending  []string
+	Websites []string
+}
+
+// garbageCollector remembers when content first became orphaned so it's only
+// removed once it has stayed that way for the grace period
+type garbageCollector struct {
+	mux      sync.Mutex
+	orphaned map[string]time.Time
+}
+
+func newGarbageCollector() *garbageCollector {
+	return &garbageCollector{orphaned: make(map[string]time.Time)}
+}
+
+// getWantedContent reads the desired state manifest if one is configured,
+// otherwise it asks the network gateway what we should still hold
+func getWantedContent(content []string) (*wantedContent, error) {
+	wanted := &wantedContent{}
+
+	if manifest := viper.GetString("GC.Manifest"); manifest != "" {
+		b, err := ioutil.ReadFile(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, wanted); err != nil {
+			return nil, err
+		}
+		return wanted, nil
+	}
+
+	c := &contentList{Content: content}
+	resp, err := postToControld(context.Background(), viper.GetString("GC.Endpoint"), c.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	// Never delete anything unless the gateway gave us a real answer
+	if success, err := jsonparser.GetBoolean(body, "success"); err != nil || !success {
+		return nil, errors.New("network gateway couldn't tell us what content is wanted")
+	}
+	response, _, _, err := jsonparser.Get(body, "response")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, wanted); err != nil {
+		return nil, err
+	}
+	return wanted, nil
+}
+
+// startGarbageCollector periodically removes content the network doesn't
+// want us to hold anymore
+func (s *State) startGarbageCollector() {
+	if !viper.GetBool("GC.Enabled") {
+		return
+	}
+
+	s.p2p.BlockUntilJoined()
+	for {
+		time.Sleep(viper.GetDuration("GC.Interval"))
+		if _, err := s.collectGarbage(viper.GetBool("GC.DryRun")); err != nil {
+			log.Warn().Err(err).Msg("Error collecting garbage, not removing anything")
+		}
+	}
+}
+
+// collectGarbage removes content that has been orphaned for longer than the
+// grace period, with dryRun it only reports what would be removed. We stop
+// serving it under the lock and delete the files once it's released.
+func (s *State) collectGarbage(dryRun bool) (*gcReport, error) {
+	wanted, err := getWantedContent(s.getContentList())
+	if err != nil {
+		return nil, err
+	}
+
+	s.gc.mux.Lock()
+	defer s.gc.mux.Unlock()
+
+	report := &gcReport{DryRun: dryRun, Removed: make([]string, 0), Pending: make([]string, 0), Websites: make([]string, 0)}
+	grace := viper.GetDuration("GC.GracePeriod")
+	now := time.Now()
+
+	s.mux.Lock()
+	orphaned := make(map[string]time.Time)
+	for _, contentName := range s.content.getContentList() {
+		if wanted.wants(contentName) || s.pins.isPinned(contentName) {
+			continue
+		}
+
+		since, ok := s.gc.orphaned[contentName]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < grace || dryRun {
+			orphaned[contentName] = since
+		}
+		if now.Sub(since) < grace {
+			report.Pending = append(report.Pending, contentName)
+			continue
+		}
+
+		if dryRun {
+			log.Info().Str("content", contentName).Msg("Garbage collection would remove orphaned asset (dry run)")
+		} else {
+			s.dropContent(contentName)
+		}
+		report.Removed = append(report.Removed, contentName)
+	}
+	s.mux.Unlock()
+	// Anything wanted again (or gone) is forgotten
+	s.gc.orphaned = orphaned
+
+	if !dryRun {
+		for _, contentName := range report.Removed {
+			if err := s.removeContentFile(contentName); err != nil {
+				log.Warn().Err(err).Str("content", contentName).Msg("Error removing orphaned asset")
+				continue
+			}
+			s.forgetContent(contentName)
+			log.Info().Str("content", contentName).Msg("Garbage collection removed orphaned asset")
+		}
+		if len(report.Removed) > 0 {
+			s.advertiseContent()
+		}
+	}
+
+	report.Websites = s.removeEmptyWebsites(wanted, dryRun)
+
+	log.Info().
+		Bool("dry_run", dryRun).
+		Int("removed", len(report.Removed)).
+		Int("pending", len(report.Pending)).
+		Int("websites_removed", len(report.Websites)).
+		Msg("Finished garbage collection")
+	return report, nil
+}
+
+// removeEmptyWebsites removes the directories of websites the network doesn't
+// want anymore that have nothing left in them. Websites being downloaded to
+// are left alone so we don't remove a directory out from under a download.
+func (s *State) removeEmptyWebsites(wanted *wantedContent, dryRun bool) []string {
+	removed := make([]string, 0)
+
+	contentDir, err := getContentDir()
+	if err != nil {
+		return removed
+	}
+	files, err := ioutil.ReadDir(contentDir)
+	if err != nil {
+		return removed
+	}
+
+	for _, f := range files {
+		website := f.Name()
+		if !f.IsDir() || strings.HasPrefix(website, ".") || wanted.wantsWebsite(website) || s.pins.websitePinned(website) {
+			continue
+		}
+
+		ok := s.websites.removeIfUnused(website, func() bool {
+			websiteFiles, err := ioutil.ReadDir(filepath.Join(contentDir, website))
+			if err != nil || len(websiteFiles) > 0 {
+				return false
+			}
+			if dryRun {
+				log.Info().Str("website", website).Msg("Garbage collection would remove empty website (dry run)")
+				return true
+			}
+			if err := os.Remove(filepath.Join(contentDir, website)); err != nil {
+				log.Warn().Err(err).Str("website", website).Msg("Error removing empty website directory")
+				return false
+			}
+			return true
+		})
+		if !ok {
+			continue
+		}
+		if !dryRun {
+			s.mux.Lock()
+			if wc := s.content.getWebsite(website); wc != nil && len(wc.assets) == 0 {
+				delete(s.content.websites, website)
+				s.websitesChanged()
+			}
+			s.mux.Unlock()
+			log.Info().Str("website", website).Msg("Garbage collection removed empty website")
+		}
+		removed = append(removed, website)
+	}
+	return removed
+}
+
+// websiteDirs keeps track of the website directories downloads are writing
+// to, so garbage collection doesn't remove one between a download creating it
+// and writing the file
+type websiteDirs struct {
+	mux   sync.Mutex
+	inUse map[string]int
+}
+
+func newWebsiteDirs() *websiteDirs {
+	return &websiteDirs{inUse: make(map[string]int)}
+}
+
+// acquire marks a website's directory as in use until release is called
+func (d *websiteDirs) acquire(website string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.inUse[website]++
+}
+
+func (d *websiteDirs) release(website string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.inUse[website]--; d.inUse[website] <= 0 {
+		delete(d.inUse, website)
+	}
+}
+
+// removeIfUnused calls remove if nothing is using the website's directory,
+// nothing can start using it until remove returns
+func (d *websiteDirs) removeIfUnused(website string, remove func() bool) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.inUse[website] > 0 {
+		return false
+	}
+	return remove()
+}
@@ -0,0 +1,183 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestWantedContent(t *testing.T) {
+	wanted := &wantedContent{Websites: []string{"whole"}, Content: []string{"partial/a"}}
+	tests := []struct {
+		content      string
+		wants        bool
+		wantsWebsite bool
+	}{
+		{"whole/a", true, true},
+		{"partial/a", true, true},
+		{"partial/b", false, true},
+		{"other/a", false, false},
+		{"part/a", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			website, _, _ := splitContentName(tt.content)
+			if got := wanted.wants(tt.content); got != tt.wants {
+				t.Errorf("wants = %v, want %v", got, tt.wants)
+			}
+			if got := wanted.wantsWebsite(website); got != tt.wantsWebsite {
+				t.Errorf("wantsWebsite = %v, want %v", got, tt.wantsWebsite)
+			}
+		})
+	}
+}
+
+func TestGetWantedContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     *wantedContent
+	}{
+		{"wanted content", `{"success": true, "response": {"websites": ["site"], "content": ["other/a"]}}`, &wantedContent{Websites: []string{"site"}, Content: []string{"other/a"}}},
+		{"gateway error", `{"success": false, "message": "not now"}`, nil},
+		{"not json", `<html>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			viper.Set("NetworkGatewayProtocol", "http")
+			viper.Set("NetworkGatewayHostname", host)
+			viper.Set("NetworkGatewayPort", port)
+
+			got, err := getWantedContent(nil)
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// setManifest makes the desired state manifest the source of what's wanted
+func setManifest(t *testing.T, wanted *wantedContent) {
+	t.Helper()
+	b, _ := json.Marshal(wanted)
+	f := filepath.Join(filepath.Dir(viper.GetString("ContentDirectory")), "manifest.json")
+	if err := ioutil.WriteFile(f, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("GC.Manifest", f)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		orphanedFor time.Duration
+		pinned      bool
+		wantRemoved int
+		wantPending int
+		wantOnDisk  bool
+	}{
+		{"newly orphaned waits for the grace period", false, 0, false, 0, 1, true},
+		{"orphaned past the grace period", false, 2 * time.Hour, false, 1, 0, false},
+		{"dry run only reports", true, 2 * time.Hour, false, 1, 0, true},
+		{"pinned is kept", false, 2 * time.Hour, true, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			viper.Set("GC.GracePeriod", time.Hour)
+			kept := addTestAsset(t, s, "wanted", []byte("kept"))
+			orphan := addTestAsset(t, s, "unwanted", []byte("orphan"))
+			setManifest(t, &wantedContent{Websites: []string{"wanted"}})
+			if tt.pinned {
+				viper.Set("Pins.Assets", []string{"unwanted/" + orphan})
+			}
+			if tt.orphanedFor > 0 {
+				s.gc.orphaned["unwanted/"+orphan] = time.Now().Add(-tt.orphanedFor)
+			}
+
+			report, err := s.collectGarbage(tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Removed) != tt.wantRemoved || len(report.Pending) != tt.wantPending {
+				t.Errorf("removed %v, pending %v", report.Removed, report.Pending)
+			}
+
+			contentDir, _ := getContentDir()
+			_, err = os.Stat(filepath.Join(contentDir, "unwanted", orphan))
+			if onDisk := err == nil; onDisk != tt.wantOnDisk {
+				t.Errorf("orphan on disk = %v, want %v", onDisk, tt.wantOnDisk)
+			}
+			if _, err := os.Stat(filepath.Join(contentDir, "wanted", kept)); err != nil {
+				t.Errorf("wanted content was removed: %v", err)
+			}
+			if served := s.content.getWebsite("unwanted") != nil && s.content.getWebsite("unwanted").getAsset(orphan) != nil; served != tt.wantOnDisk {
+				t.Errorf("orphan served = %v, want %v", served, tt.wantOnDisk)
+			}
+		})
+	}
+}
+
+func TestCollectGarbageWithoutAnswer(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("GC.Manifest", filepath.Join(filepath.Dir(viper.GetString("ContentDirectory")), "missing.json"))
+	asset := addTestAsset(t, s, "site", []byte("asset"))
+
+	if _, err := s.collectGarbage(false); err == nil {
+		t.Fatal("collected garbage without knowing what's wanted")
+	}
+	if s.content.getWebsite("site").getAsset(asset) == nil {
+		t.Error("removed content without knowing what's wanted")
+	}
+}
+
+func TestRemoveEmptyWebsites(t *testing.T) {
+	s := newTestState(t)
+	contentDir, _ := getContentDir()
+	for _, website := range []string{"wanted", "partly-wanted", "unwanted", "downloading", "pinned"} {
+		if err := os.MkdirAll(filepath.Join(contentDir, website), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTestAsset(t, s, "not-empty", []byte("asset"))
+	viper.Set("Pins.Websites", []string{"pinned"})
+	wanted := &wantedContent{Websites: []string{"wanted"}, Content: []string{"partly-wanted/" + hashName([]byte("a"))}}
+
+	s.websites.acquire("downloading")
+	dryRun := s.removeEmptyWebsites(wanted, true)
+	removed := s.removeEmptyWebsites(wanted, false)
+	s.websites.release("downloading")
+
+	for _, got := range [][]string{dryRun, removed} {
+		sort.Strings(got)
+		if len(got) != 1 || got[0] != "unwanted" {
+			t.Fatalf("removed %v, want only the unwanted website", got)
+		}
+	}
+	for website, want := range map[string]bool{"wanted": true, "partly-wanted": true, "unwanted": false, "downloading": true, "pinned": true, "not-empty": true} {
+		_, err := os.Stat(filepath.Join(contentDir, website))
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists = %v, want %v", website, exists, want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	assetsBucket = []byte("assets")
+	statsBucket  = []byte("stats")
+	statsKey     = []byte("access")
+)
+
+// indexEntry is what we know about an asset on disk, keyed by its content name
+// (<website name>/<fileName>)
+type indexEntry struct {
+	Size       int64     `json:"size"`
+	Verified   bool      `json:"verified"`
+	ModTime    time.Time `json:"mtime"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastAccess time.Time `json:"last_access"`
+	Hits       uint64    `json:"hits"`
+}
+
+// matches returns true if the file on disk hasn't changed since it was indexed
+func (e *indexEntry) matches(fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// contentIndex is a persistent index of the content directory so we don't
+// have to read and hash every asset on startup. If the index can't be opened
+// everything still works, we just treat every asset as new.
+type contentIndex struct {
+	db *bolt.DB
+	// Why we're running without an index, if we are
+	err error
+}
+
+func openIndex() *contentIndex {
+	indexFile := viper.GetString("Index.File")
+	if indexFile == "" {
+		return &contentIndex{}
+	}
+	if err := os.MkdirAll(filepath.Dir(indexFile), os.ModePerm); err != nil {
+		log.Warn().Err(err).Msg("Error creating content index directory, running without an index")
+		return &contentIndex{err: err}
+	}
+
+	db, err := bolt.Open(indexFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Warn().Err(err).Str("file", indexFile).Msg("Error opening content index, running without an index")
+		return &contentIndex{err: err}
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{assetsBucket, statsBucket, hourlyBucket, dailyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("file", indexFile).Msg("Error setting up content index, running without an index")
+		db.Close()
+		return &contentIndex{err: err}
+	}
+	return &contentIndex{db: db}
+}
+
+// load returns every indexed asset
+func (ix *contentIndex) load() map[string]*indexEntry {
+	entries := make(map[string]*indexEntry)
+	if ix.db == nil {
+		return entries
+	}
+
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(assetsBucket).ForEach(func(k, v []byte) error {
+			e := &indexEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				// A bad entry is just treated like a new asset
+				return nil
+			}
+			entries[string(k)] = e
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error reading content index")
+	}
+	return entries
+}
+
+// get returns the entry for an asset, nil if it isn't indexed
+func (ix *contentIndex) get(contentName string) *indexEntry {
+	if ix.db == nil {
+		return nil
+	}
+
+	var e *indexEntry
+	ix.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(assetsBucket).Get([]byte(contentName))
+		if v != nil {
+			e = &indexEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				e = nil
+			}
+		}
+		return nil
+	})
+	return e
+}
+
+// put writes the entries in a single transaction
+func (ix *contentIndex) put(entries map[string]*indexEntry) {
+	if ix.db == nil || len(entries) == 0 {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(assetsBucket)
+		for contentName, e := range entries {
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(contentName), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error updating content index")
+	}
+}
+
+// remove drops assets from the index
+func (ix *contentIndex) remove(contentNames ...string) {
+	if ix.db == nil || len(contentNames) == 0 {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(assetsBucket)
+		for _, contentName := range contentNames {
+			if err := b.Delete([]byte(contentName)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error removing assets from the content index")
+	}
+}
+
+// recordAccess saves how often and how recently assets were served
+func (ix *contentIndex) recordAccess(access map[string]assetAccess) {
+	if ix.db == nil || len(access) == 0 {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(assetsBucket)
+		for contentName, a := range access {
+			v := b.Get([]byte(contentName))
+			if v == nil {
+				continue
+			}
+			e := &indexEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				continue
+			}
+			e.LastAccess = a.lastAccess
+			e.Hits = a.hits
+			v, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(contentName), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Error saving asset access to the content index")
+	}
+}
+
+// loadValues returns every value in a bucket
+func (ix *contentIndex) loadValues(bucket []byte) map[string][]byte {
+	values := make(map[string][]byte)
+	if ix.db == nil {
+		return values
+	}
+
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", string(bucket)).Msg("Error reading from the index")
+	}
+	return values
+}
+
+// putValues writes values to a bucket in a single transaction, keys with a
+// nil value are deleted
+func (ix *contentIndex) putValues(bucket []byte, values map[string][]byte) error {
+	if ix.db == nil || len(values) == 0 {
+		return nil
+	}
+
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for k, v := range values {
+			var err error
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// markVerified indexes an asset we just downloaded and verified ourselves, so
+// the next load doesn't hash it again
+func (s *State) markVerified(contentName string) {
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return
+	}
+	contentDir, err := getContentDir()
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(filepath.Join(contentDir, website, asset))
+	if err != nil {
+		return
+	}
+
+	e := s.index.get(contentName)
+	if e == nil {
+		e = &indexEntry{FirstSeen: time.Now()}
+	}
+	e.Size = fi.Size()
+	e.ModTime = fi.ModTime()
+	e.Verified = true
+	s.index.put(map[string]*indexEntry{contentName: e})
+}
+
+// startIndexFlusher periodically saves asset access to the index so eviction
+// order survives restarts
+func (s *State) startIndexFlusher() {
+	for {
+		time.Sleep(viper.GetDuration("Index.FlushInterval"))
+		s.index.recordAccess(s.storage.dirty())
+	}
+}
@@ -0,0 +1,78 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestContentIndex(t *testing.T) {
+	viper.Set("Index.File", filepath.Join(t.TempDir(), "index.db"))
+	defer viper.Reset()
+
+	ix := openIndex()
+	if ix.db == nil {
+		t.Fatal("index wasn't opened")
+	}
+	defer ix.db.Close()
+
+	modTime := time.Now().Round(time.Second)
+	ix.put(map[string]*indexEntry{
+		"site/a": {Size: 1, Verified: true, ModTime: modTime},
+		"site/b": {Size: 2, ModTime: modTime},
+	})
+	if e := ix.get("site/a"); e == nil || e.Size != 1 || !e.Verified || !e.ModTime.Equal(modTime) {
+		t.Fatalf("get() = %+v", e)
+	}
+	if e := ix.get("site/missing"); e != nil {
+		t.Fatalf("get() = %+v for an asset that isn't indexed", e)
+	}
+
+	lastAccess := time.Now().Round(time.Second)
+	ix.recordAccess(map[string]assetAccess{
+		"site/a":       {lastAccess: lastAccess, hits: 3},
+		"site/missing": {lastAccess: lastAccess, hits: 1},
+	})
+	ix.remove("site/b")
+
+	entries := ix.load()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(entries))
+	}
+	if e := entries["site/a"]; e == nil || e.Hits != 3 || !e.LastAccess.Equal(lastAccess) {
+		t.Errorf("site/a = %+v, want its access recorded", e)
+	}
+}
+
+func TestIndexEntryMatches(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "asset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("asset")
+	f.Close()
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		entry indexEntry
+		want  bool
+	}{
+		{"unchanged", indexEntry{Size: fi.Size(), ModTime: fi.ModTime()}, true},
+		{"different size", indexEntry{Size: fi.Size() + 1, ModTime: fi.ModTime()}, false},
+		{"modified since", indexEntry{Size: fi.Size(), ModTime: fi.ModTime().Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.matches(fi); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// syncControl lets an operator pause syncing or run a sync round right away
+type syncControl struct {
+	mux     sync.Mutex
+	paused  bool
+	trigger chan struct{}
+}
+
+func newSyncControl() *syncControl {
+	return &syncControl{trigger: make(chan struct{}, 1)}
+}
+
+func (c *syncControl) isPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.paused
+}
+
+func (c *syncControl) setPaused(paused bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.paused = paused
+}
+
+// runNow queues a sync round, one is enough if several are asked for at once
+func (c *syncControl) runNow() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SyncStatus says if syncing is paused
+type SyncStatus struct {
+	Paused bool `json:"paused"`
+}
+
+// SyncStatus returns if syncing is paused
+func (s *State) SyncStatus() SyncStatus {
+	return SyncStatus{Paused: s.syncing.isPaused()}
+}
+
+// PauseSync stops downloading content we need until ResumeSync is called,
+// tombstones from the network are still applied
+func (s *State) PauseSync() SyncStatus {
+	s.syncing.setPaused(true)
+	log.Info().Msg("Content sync paused")
+	return s.SyncStatus()
+}
+
+// ResumeSync resumes syncing and catches up on what we missed with a sync round
+func (s *State) ResumeSync() SyncStatus {
+	s.syncing.setPaused(false)
+	s.syncing.runNow()
+	log.Info().Msg("Content sync resumed")
+	return s.SyncStatus()
+}
+
+// SyncNow runs a sync round without waiting for the next poll, it runs once
+// we have joined the network
+func (s *State) SyncNow() error {
+	if s.syncing.isPaused() {
+		return errors.New("content sync is paused")
+	}
+	s.syncing.runNow()
+	return nil
+}
+
+// Rescan reloads the content directory, verifying anything that changed
+// since it was indexed
+func (s *State) Rescan() {
+	log.Info().Msg("Rescanning content directory")
+	s.loadContentFromDisk()
+}
+
+// DeleteAsset removes an asset from this node, unlike a tombstone it can be
+// downloaded again if the network still wants us to have it
+func (s *State) DeleteAsset(website, asset string) error {
+	if !validContentName(website) || !validContentName(asset) {
+		return errors.New("invalid website or asset name")
+	}
+
+	s.mux.Lock()
+	_, ok := s.assetData(website, asset)
+	s.mux.Unlock()
+	if !ok {
+		return errors.New("asset not found")
+	}
+
+	// Remove it from disk first, then stop serving it
+	contentName := strings.Join([]string{website, asset}, "/")
+	if err := s.removeContentFile(contentName); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.dropContent(contentName)
+	s.mux.Unlock()
+	s.forgetContent(contentName)
+
+	log.Info().Str("website", website).Str("asset", asset).Msg("Deleted asset")
+	s.advertiseContent()
+	return nil
+}
+
+// VerifyResult is the outcome of checking an asset against its hash
+type VerifyResult struct {
+	Website  string `json:"website"`
+	Asset    string `json:"asset"`
+	Size     int64  `json:"size"`
+	Verified bool   `json:"verified"`
+	Removed  bool   `json:"removed"`
+}
+
+// VerifyAsset reads an asset from disk and checks it against its hash even if
+// the index says it's unchanged, an asset that doesn't match is removed
+func (s *State) VerifyAsset(website, asset string) (*VerifyResult, error) {
+	if !validContentName(website) || !validContentName(asset) {
+		return nil, errors.New("invalid website or asset name")
+	}
+
+	s.mux.Lock()
+	_, ok := s.assetData(website, asset)
+	s.mux.Unlock()
+	if !ok {
+		return nil, errors.New("asset not found")
+	}
+
+	// Keep the access history, but make readAsset hash it again
+	contentName := strings.Join([]string{website, asset}, "/")
+	e := s.index.get(contentName)
+	if e != nil {
+		e.Verified = false
+	}
+
+	// Hash it without holding up requests
+	result := &VerifyResult{Website: website, Asset: asset}
+	b, verified, err := s.readAsset(website, asset, e)
+	if err != nil {
+		if verified {
+			// Couldn't read it, which says nothing about its content
+			return nil, err
+		}
+		log.Warn().Err(err).Str("content", contentName).Msg("Removing asset that failed verification")
+		if err := s.removeContentFile(contentName); err != nil {
+			return nil, err
+		}
+		s.mux.Lock()
+		s.dropContent(contentName)
+		s.mux.Unlock()
+		s.forgetContent(contentName)
+		s.advertiseContent()
+		result.Removed = true
+		return result, nil
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// It could have been removed while we were hashing it
+	wc := s.content.getWebsite(website)
+	if wc == nil || wc.getAsset(asset) == nil {
+		return nil, errors.New("asset not found")
+	}
+	a := wc.getAsset(asset)
+	// Only keep it in memory if it already was, lazy assets stay lazy
+	if a.data != nil {
+		a.data = b
+	}
+	a.size = int64(len(b))
+	result.Size = a.size
+	result.Verified = true
+	return result, nil
+}
+
+// IndexReady returns an error until the content directory has been scanned,
+// or if the content index couldn't be opened
+func (s *State) IndexReady() error {
+	if s.index.err != nil {
+		return errors.New("content index couldn't be opened: " + s.index.err.Error())
+	}
+
+	if atomic.LoadInt32(&s.scanned) == 0 {
+		return errors.New("content directory hasn't been scanned yet")
+	}
+	return nil
+}
+
+// Running returns false once we've started shutting down
+func (s *State) Running() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// Stop marks us as shutting down so we stop reporting ready
+func (s *State) Stop() {
+	atomic.StoreInt32(&s.running, 0)
+}
@@ -0,0 +1,170 @@
+package state
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDeleteAsset(t *testing.T) {
+	tests := []struct {
+		name    string
+		website string
+		asset   func(have string) string
+		wantErr bool
+	}{
+		{"asset we have", "site", func(have string) string { return have }, false},
+		{"asset we don't have", "site", func(string) string { return hashName([]byte("missing")) }, true},
+		{"invalid name", "..", func(have string) string { return have }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			have := addTestAsset(t, s, "site", []byte("asset"))
+			asset := tt.asset(have)
+
+			err := s.DeleteAsset(tt.website, asset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if published(s) {
+					t.Error("published after a failed delete")
+				}
+				return
+			}
+
+			contentDir, _ := getContentDir()
+			if _, err := os.Stat(filepath.Join(contentDir, "site", asset)); !os.IsNotExist(err) {
+				t.Error("asset is still on disk")
+			}
+			if s.content.getWebsite("site").getAsset(asset) != nil {
+				t.Error("asset is still served")
+			}
+			if !published(s) {
+				t.Error("the network wasn't told about the delete")
+			}
+		})
+	}
+}
+
+func TestVerifyAsset(t *testing.T) {
+	tests := []struct {
+		name        string
+		corrupt     bool
+		wantRemoved bool
+	}{
+		{"matches its hash", false, false},
+		{"corrupted on disk", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			asset := addTestAsset(t, s, "site", []byte("asset"))
+			if tt.corrupt {
+				contentDir, _ := getContentDir()
+				if err := ioutil.WriteFile(filepath.Join(contentDir, "site", asset), []byte("corrupted"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := s.VerifyAsset("site", asset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Removed != tt.wantRemoved || result.Verified == tt.wantRemoved {
+				t.Errorf("result = %+v", result)
+			}
+			if served := s.content.getWebsite("site").getAsset(asset) != nil; served == tt.wantRemoved {
+				t.Errorf("served = %v after verifying", served)
+			}
+		})
+	}
+
+	s := newTestState(t)
+	if _, err := s.VerifyAsset("site", hashName([]byte("missing"))); err == nil {
+		t.Error("verified an asset we don't have")
+	}
+}
+
+func TestSyncControl(t *testing.T) {
+	s := newTestState(t)
+
+	if status := s.PauseSync(); !status.Paused {
+		t.Fatal("not paused")
+	}
+	if err := s.SyncNow(); err == nil {
+		t.Fatal("started a sync round while paused")
+	}
+
+	// Resuming catches up with a round right away, more requests while it's
+	// queued are the same round
+	if status := s.ResumeSync(); status.Paused {
+		t.Fatal("still paused")
+	}
+	if err := s.SyncNow(); err != nil {
+		t.Fatal(err)
+	}
+	<-s.syncing.trigger
+	select {
+	case <-s.syncing.trigger:
+		t.Fatal("more than one round queued")
+	default:
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	s := newTestState(t)
+	if err := s.IndexReady(); err == nil {
+		t.Error("ready before the content directory was scanned")
+	}
+	s.loadContentFromDisk()
+	if err := s.IndexReady(); err != nil {
+		t.Errorf("not ready after scanning: %v", err)
+	}
+	s.index.err = errors.New("locked by another process")
+	if err := s.IndexReady(); err == nil {
+		t.Error("ready without an index")
+	}
+
+	if !s.Running() {
+		t.Error("not running before stopping")
+	}
+	s.Stop()
+	if s.Running() {
+		t.Error("still running after stopping")
+	}
+}
+
+func TestPublishUnlessLeft(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Advertise.Filter", filterOff)
+	g, p2p := newFakeGateway(t)
+	s.p2p = p2p
+	addTestAsset(t, s, "site", []byte("asset"))
+
+	s.publishUnlessLeft()
+	if g.count() != 1 {
+		t.Fatalf("published %d times, want once", g.count())
+	}
+
+	if err := p2p.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	s.publishUnlessLeft()
+	if g.count() != 1 {
+		t.Error("published after leaving the network")
+	}
+
+	if err := p2p.Join(); err != nil {
+		t.Fatal(err)
+	}
+	s.publishUnlessLeft()
+	if g.count() != 2 {
+		t.Errorf("published %d times after joining again, want 2", g.count())
+	}
+}
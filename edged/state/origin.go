@@ -0,0 +1,81 @@
+package state
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Where a fetched asset came from
+const (
+	sourceParent = "parent"
+	sourcePeer   = "peer"
+	sourceOrigin = "origin"
+)
+
+// originConfig is a website's authoritative origin server, the URL is a
+// template where {website} and {asset} are replaced with the requested asset
+type originConfig struct {
+	Website string
+	URL     string
+}
+
+// getOriginURL returns the origin URL of an asset if the website has an origin
+// configured
+func getOriginURL(website, asset string) (string, bool) {
+	var origins []originConfig
+	if err := viper.UnmarshalKey("Origins", &origins); err != nil {
+		log.Warn().Err(err).Msg("Error reading website origins from the config")
+		return "", false
+	}
+
+	for _, o := range origins {
+		if o.Website == website && o.URL != "" {
+			r := strings.NewReplacer("{website}", website, "{asset}", asset)
+			return r.Replace(o.URL), true
+		}
+	}
+	return "", false
+}
+
+// fetchCounters counts the fetches from our parent, peers and origins separately
+type fetchCounters struct {
+	ParentFetches  uint64
+	ParentFailures uint64
+	PeerFetches    uint64
+	PeerFailures   uint64
+	OriginFetches  uint64
+	OriginFailures uint64
+}
+
+func (f *fetchCounters) record(source, url string, err error) {
+	metrics.Downloads.WithLabelValues(source, metrics.Peer(url), metrics.Result(err)).Inc()
+	switch {
+	case source == sourceParent && err == nil:
+		atomic.AddUint64(&f.ParentFetches, 1)
+	case source == sourceParent:
+		atomic.AddUint64(&f.ParentFailures, 1)
+	case source == sourcePeer && err == nil:
+		atomic.AddUint64(&f.PeerFetches, 1)
+	case source == sourcePeer:
+		atomic.AddUint64(&f.PeerFailures, 1)
+	case source == sourceOrigin && err == nil:
+		atomic.AddUint64(&f.OriginFetches, 1)
+	case source == sourceOrigin:
+		atomic.AddUint64(&f.OriginFailures, 1)
+	}
+}
+
+func (f *fetchCounters) snapshot() fetchCounters {
+	return fetchCounters{
+		ParentFetches:  atomic.LoadUint64(&f.ParentFetches),
+		ParentFailures: atomic.LoadUint64(&f.ParentFailures),
+		PeerFetches:    atomic.LoadUint64(&f.PeerFetches),
+		PeerFailures:   atomic.LoadUint64(&f.PeerFailures),
+		OriginFetches:  atomic.LoadUint64(&f.OriginFetches),
+		OriginFailures: atomic.LoadUint64(&f.OriginFailures),
+	}
+}
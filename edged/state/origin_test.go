@@ -0,0 +1,92 @@
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetOriginURL(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("Origins", []map[string]string{
+		{"website": "site", "url": "https://origin.example.com/{website}/{asset}"},
+		{"website": "empty", "url": ""},
+	})
+
+	tests := []struct {
+		website string
+		want    string
+		wantOK  bool
+	}{
+		{"site", "https://origin.example.com/site/asset", true},
+		{"empty", "", false},
+		{"other", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := getOriginURL(tt.website, "asset")
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("getOriginURL(%q) = %q, %v, want %q, %v", tt.website, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSplitContentName(t *testing.T) {
+	tests := []struct {
+		contentName   string
+		website, file string
+		wantOK        bool
+	}{
+		{"site/asset", "site", "asset", true},
+		{"site", "", "", false},
+		{"site/a/b", "", "", false},
+		{"../asset", "", "", false},
+		{"site/", "", "", false},
+	}
+	for _, tt := range tests {
+		website, file, ok := splitContentName(tt.contentName)
+		if website != tt.website || file != tt.file || ok != tt.wantOK {
+			t.Errorf("splitContentName(%q) = %q, %q, %v", tt.contentName, website, file, ok)
+		}
+	}
+}
+
+func TestPullAssetFromOrigin(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("PullThrough.Enabled", true)
+	viper.Set("PullThrough.Timeout", time.Minute)
+	data := []byte("from the origin")
+	asset := hashName(data)
+
+	// The peer fails, so the asset has to come from the origin
+	peer := httptest.NewServer(http.NotFoundHandler())
+	defer peer.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/site/"+asset {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer origin.Close()
+	newTestLocations(t, map[string][]string{"site/" + asset: {peer.URL}})
+	viper.Set("Origins", []map[string]string{{"website": "site", "url": origin.URL + "/{website}/{asset}"}})
+
+	r, _, err := s.PullAsset(context.Background(), "site", asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if err := r.Close(); err != nil || string(b) != string(data) {
+		t.Fatalf("pulled %q, err = %v", b, err)
+	}
+
+	got := s.fetches.snapshot()
+	if got != (fetchCounters{PeerFailures: 1, OriginFetches: 1}) {
+		t.Errorf("fetches = %+v", got)
+	}
+}
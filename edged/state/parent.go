@@ -0,0 +1,28 @@
+package state
+
+import (
+	"net/url"
+
+	"github.com/spf13/viper"
+)
+
+// getParentURL returns the URL of an asset on our parent edge node if one is
+// configured. Parents are asked before any peers, and with pull-through
+// enabled on the parent this gives a two tier cache.
+func getParentURL(website, asset string) (string, bool) {
+	address := viper.GetString("ParentEdge.Address")
+	if address == "" {
+		return "", false
+	}
+
+	q := url.Values{}
+	q.Set("website", website)
+	q.Set("asset", asset)
+	u := url.URL{
+		Scheme:   viper.GetString("ParentEdge.Protocol"),
+		Host:     address,
+		Path:     "/content",
+		RawQuery: q.Encode(),
+	}
+	return u.String(), true
+}
@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetParentURL(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantOK  bool
+	}{
+		{"parent.example.com:8080", "https://parent.example.com:8080/content?asset=a%2Fb&website=site", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		viper.Set("ParentEdge.Address", tt.address)
+		viper.Set("ParentEdge.Protocol", "https")
+		got, ok := getParentURL("site", "a/b")
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("getParentURL with %q = %q, %v, want %q, %v", tt.address, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	viper.Reset()
+}
+
+func TestPullAssetFromParent(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("PullThrough.Enabled", true)
+	viper.Set("PullThrough.Timeout", time.Minute)
+	data := []byte("from the parent")
+	asset := hashName(data)
+
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/content" || r.URL.Query().Get("asset") != asset {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer parent.Close()
+	viper.Set("ParentEdge.Address", strings.TrimPrefix(parent.URL, "http://"))
+	viper.Set("ParentEdge.Protocol", "http")
+	// No peer is ever asked
+	newTestLocations(t, map[string][]string{})
+
+	r, _, err := s.PullAsset(context.Background(), "site", asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if err := r.Close(); err != nil || string(b) != string(data) {
+		t.Fatalf("pulled %q, err = %v", b, err)
+	}
+	if got := s.fetches.snapshot(); got != (fetchCounters{ParentFetches: 1}) {
+		t.Errorf("fetches = %+v", got)
+	}
+}
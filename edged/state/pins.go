@@ -0,0 +1,217 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// pinSet is the websites and assets that are kept on this node no matter
+// what, they are never evicted or garbage collected. Pins from the config are
+// permanent, the rest are persisted in the pins file.
+type pinSet struct {
+	mux      sync.Mutex
+	Websites []string `json:"websites"`
+	Assets   []string `json:"assets"`
+}
+
+// loadPins reads the pins file, a missing file is an empty set
+func loadPins() *pinSet {
+	p := &pinSet{Websites: make([]string, 0), Assets: make([]string, 0)}
+
+	b, err := ioutil.ReadFile(viper.GetString("Pins.File"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("Error reading pins file, starting with no pins")
+		}
+		return p
+	}
+	if err := json.Unmarshal(b, p); err != nil {
+		log.Warn().Err(err).Msg("Pins file is corrupted, starting with no pins")
+	}
+	return p
+}
+
+// save writes the pins file atomically, the caller must hold the lock
+func (p *pinSet) save() error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	pinsFile := viper.GetString("Pins.File")
+	if err := os.MkdirAll(filepath.Dir(pinsFile), os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pinsFile+"_temp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(pinsFile+"_temp", pinsFile)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	kept := make([]string, 0, len(list))
+	for _, l := range list {
+		if l != s {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// websitePinned returns true if the whole website is pinned
+func (p *pinSet) websitePinned(website string) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return contains(viper.GetStringSlice("Pins.Websites"), website) || contains(p.Websites, website)
+}
+
+// isPinned returns true if the content (<website name>/<fileName>) or its
+// website is pinned
+func (p *pinSet) isPinned(contentName string) bool {
+	website, _, _ := splitContentName(contentName)
+	if p.websitePinned(website) {
+		return true
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return contains(viper.GetStringSlice("Pins.Assets"), contentName) || contains(p.Assets, contentName)
+}
+
+// assets returns every pinned asset
+func (p *pinSet) assets() []string {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	assets := append([]string{}, viper.GetStringSlice("Pins.Assets")...)
+	for _, a := range p.Assets {
+		if !contains(assets, a) {
+			assets = append(assets, a)
+		}
+	}
+	return assets
+}
+
+// Pins is every pinned website and asset
+type Pins struct {
+	Websites []string `json:"websites"`
+	Assets   []string `json:"assets"`
+}
+
+// Pins returns every pinned website and asset, from the config and the pins
+// file
+func (s *State) Pins() Pins {
+	websites := append([]string{}, viper.GetStringSlice("Pins.Websites")...)
+
+	s.pins.mux.Lock()
+	for _, w := range s.pins.Websites {
+		if !contains(websites, w) {
+			websites = append(websites, w)
+		}
+	}
+	s.pins.mux.Unlock()
+
+	assets := s.pins.assets()
+	sort.Strings(websites)
+	sort.Strings(assets)
+	return Pins{Websites: websites, Assets: assets}
+}
+
+// Pin pins a whole website, or a single asset of it if asset isn't empty
+func (s *State) Pin(website, asset string) error {
+	if !validContentName(website) || (asset != "" && !validContentName(asset)) {
+		return errors.New("invalid website or asset name")
+	}
+
+	s.pins.mux.Lock()
+	defer s.pins.mux.Unlock()
+
+	if asset == "" {
+		if contains(s.pins.Websites, website) {
+			return nil
+		}
+		s.pins.Websites = append(s.pins.Websites, website)
+	} else {
+		contentName := strings.Join([]string{website, asset}, "/")
+		if contains(s.pins.Assets, contentName) {
+			return nil
+		}
+		s.pins.Assets = append(s.pins.Assets, contentName)
+	}
+
+	log.Info().Str("website", website).Str("asset", asset).Msg("Pinned content")
+	return s.pins.save()
+}
+
+// Unpin removes a website or asset pin, pins from the config can't be removed
+func (s *State) Unpin(website, asset string) error {
+	contentName := website
+	configPins := viper.GetStringSlice("Pins.Websites")
+	if asset != "" {
+		contentName = strings.Join([]string{website, asset}, "/")
+		configPins = viper.GetStringSlice("Pins.Assets")
+	}
+	if contains(configPins, contentName) {
+		return errors.New("content is pinned in the config file")
+	}
+
+	s.pins.mux.Lock()
+	defer s.pins.mux.Unlock()
+
+	if asset == "" {
+		s.pins.Websites = remove(s.pins.Websites, website)
+	} else {
+		s.pins.Assets = remove(s.pins.Assets, contentName)
+	}
+
+	log.Info().Str("website", website).Str("asset", asset).Msg("Unpinned content")
+	return s.pins.save()
+}
+
+// prioritizePins puts pinned content first, followed by any pinned assets we
+// don't have that the network didn't mention
+func (s *State) prioritizePins(contentNeeded []string) []string {
+	pinned := make([]string, 0)
+	rest := make([]string, 0, len(contentNeeded))
+	for _, contentName := range contentNeeded {
+		if s.pins.isPinned(contentName) {
+			pinned = append(pinned, contentName)
+		} else {
+			rest = append(rest, contentName)
+		}
+	}
+
+	s.mux.Lock()
+	for _, contentName := range s.pins.assets() {
+		website, asset, ok := splitContentName(contentName)
+		if !ok || contains(pinned, contentName) {
+			continue
+		}
+		if wc := s.content.getWebsite(website); wc == nil || wc.getAsset(asset) == nil {
+			pinned = append(pinned, contentName)
+		}
+	}
+	s.mux.Unlock()
+
+	return append(pinned, rest...)
+}
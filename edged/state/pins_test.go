@@ -0,0 +1,64 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPins(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Pins.Websites", []string{"config-site"})
+	viper.Set("Pins.Assets", []string{"other/config-asset"})
+
+	if err := s.Pin("site", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pin("other", "asset"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"site/anything", true},
+		{"config-site/anything", true},
+		{"other/asset", true},
+		{"other/config-asset", true},
+		{"other/unpinned", false},
+		{"unpinned/asset", false},
+	}
+	for _, tt := range tests {
+		if got := s.pins.isPinned(tt.content); got != tt.want {
+			t.Errorf("isPinned(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+
+	// Runtime pins survive a restart, config pins can't be removed
+	if got := loadPins(); !reflect.DeepEqual(got.Websites, []string{"site"}) || !reflect.DeepEqual(got.Assets, []string{"other/asset"}) {
+		t.Errorf("pins file has %v %v", got.Websites, got.Assets)
+	}
+	if err := s.Unpin("config-site", ""); err == nil {
+		t.Error("unpinned a website pinned in the config")
+	}
+	if err := s.Unpin("site", ""); err != nil || s.pins.isPinned("site/anything") {
+		t.Errorf("website still pinned: %v", err)
+	}
+	if err := s.Pin("../site", ""); err == nil {
+		t.Error("pinned an invalid website name")
+	}
+}
+
+func TestPrioritizePins(t *testing.T) {
+	s := newTestState(t)
+	have := addTestAsset(t, s, "pinned", []byte("have"))
+	viper.Set("Pins.Assets", []string{"pinned/" + have, "pinned/missing", "pinned/needed"})
+
+	got := s.prioritizePins([]string{"site/a", "pinned/needed", "site/b"})
+	want := []string{"pinned/needed", "pinned/missing", "site/a", "site/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,418 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/tracing"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrAssetNotFound is returned when an asset can't be found locally or in the
+// network
+var ErrAssetNotFound = errors.New("asset not found")
+
+// fetchCall is a single in flight fetch of an asset, any other requests for
+// the same asset wait on it instead of starting their own
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// pullThrough keeps track of in flight fetches and recent misses so we can
+// coalesce requests and avoid fetch storms for assets nobody has
+type pullThrough struct {
+	mux      sync.Mutex
+	inFlight map[string]*fetchCall
+	misses   map[string]time.Time
+}
+
+func newPullThrough() *pullThrough {
+	return &pullThrough{inFlight: make(map[string]*fetchCall), misses: make(map[string]time.Time)}
+}
+
+// start returns the in flight call for the key and whether or not the caller
+// is the one that should do the fetch
+func (p *pullThrough) start(key string) (*fetchCall, bool, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if expires, ok := p.misses[key]; ok {
+		if time.Now().Before(expires) {
+			return nil, false, ErrAssetNotFound
+		}
+		delete(p.misses, key)
+	}
+
+	if call, ok := p.inFlight[key]; ok {
+		return call, false, nil
+	}
+	// Every fetch asks the gateway where the asset is, so don't let a flood of
+	// requests for assets we don't have turn into a flood of gateway calls
+	if max := viper.GetInt("PullThrough.MaxInFlight"); max > 0 && len(p.inFlight) >= max {
+		return nil, false, ErrAssetNotFound
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	p.inFlight[key] = call
+	return call, true, nil
+}
+
+// finish releases anyone waiting on the call, failures are remembered for the
+// configured time so we don't keep asking the network for the same asset
+func (p *pullThrough) finish(key string, call *fetchCall, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if err != nil {
+		p.addMiss(key, time.Now())
+	}
+	delete(p.inFlight, key)
+
+	call.err = err
+	close(call.done)
+}
+
+// addMiss remembers a failed fetch, keeping at most PullThrough.MaxMisses so
+// requests for random assets can't grow the map forever. The caller must
+// hold the lock.
+func (p *pullThrough) addMiss(key string, now time.Time) {
+	max := viper.GetInt("PullThrough.MaxMisses")
+	if _, ok := p.misses[key]; !ok && max > 0 && len(p.misses) >= max {
+		p.sweep(now)
+		// Still full of misses that haven't expired, make room for this one
+		for k := range p.misses {
+			if len(p.misses) < max {
+				break
+			}
+			delete(p.misses, k)
+		}
+	}
+	p.misses[key] = now.Add(viper.GetDuration("PullThrough.NegativeCacheTTL"))
+}
+
+// sweep forgets the misses that have expired, the caller must hold the lock
+func (p *pullThrough) sweep(now time.Time) {
+	for key, expires := range p.misses {
+		if !now.Before(expires) {
+			delete(p.misses, key)
+		}
+	}
+}
+
+// startSweeper periodically forgets expired misses of assets nobody asked
+// for again
+func (p *pullThrough) startSweeper() {
+	if !viper.GetBool("PullThrough.Enabled") {
+		return
+	}
+
+	ticker := time.NewTicker(viper.GetDuration("PullThrough.NegativeCacheTTL"))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.mux.Lock()
+		p.sweep(now)
+		p.mux.Unlock()
+	}
+}
+
+// PullAsset fetches an asset we don't have on disk from our parent edge or a
+// peer in the network, or from the website's origin if no peer has it. The
+// returned reader streams the asset as it is downloaded. The download runs on
+// its own, so a slow client doesn't hold it up, and once it is done the hash
+// is verified and the asset is stored. Concurrent requests for the same asset
+// share a single fetch. The size is -1 while the asset is still downloading,
+// what a peer claims up front isn't checked until the download is done.
+func (s *State) PullAsset(ctx context.Context, website, asset string) (io.ReadCloser, int, error) {
+	if !viper.GetBool("PullThrough.Enabled") {
+		return nil, 0, ErrAssetNotFound
+	}
+	if !validContentName(website) || !validContentName(asset) {
+		return nil, 0, ErrAssetNotFound
+	}
+
+	key := strings.Join([]string{website, asset}, "/")
+	if s.tombstones.isTombstoned(key) {
+		return nil, 0, ErrAssetNotFound
+	}
+	call, leader, err := s.pulls.start(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Someone else is fetching this, wait for them and serve it from memory
+	if !leader {
+		<-call.done
+		if call.err != nil {
+			return nil, 0, ErrAssetNotFound
+		}
+		a := s.GetAsset(website, asset)
+		if a == nil {
+			return nil, 0, ErrAssetNotFound
+		}
+		return ioutil.NopCloser(bytes.NewReader(a)), len(a), nil
+	}
+
+	f, err := s.openPullFetch(ctx, key, call, website, asset)
+	if err != nil {
+		log.Debug().Err(err).Str("content", key).Msg("Could not pull asset from the network")
+		s.pulls.finish(key, call, err)
+		return nil, 0, ErrAssetNotFound
+	}
+	go f.run()
+	return &pullReader{f: f}, -1, nil
+}
+
+// fetchCandidate is somewhere we can try to fetch an asset from
+type fetchCandidate struct {
+	url    string
+	source string
+}
+
+// openPullFetch finds a parent, peer or origin that has the asset and starts
+// downloading it
+func (s *State) openPullFetch(ctx context.Context, key string, call *fetchCall, website, asset string) (f *pullFetch, err error) {
+	ctx, span := tracing.Start(ctx, "pull_through", attribute.String("content.name", key))
+	defer func() {
+		if f != nil {
+			span.SetAttributes(attribute.String("content.source", f.source), attribute.String("url.full", f.url))
+		}
+		tracing.End(span, err)
+	}()
+
+	contentDir, err := getContentDir()
+	if err != nil {
+		return nil, err
+	}
+	// Released once the fetch is done
+	s.websites.acquire(website)
+	defer func() {
+		if f == nil {
+			s.websites.release(website)
+		}
+	}()
+
+	// Try our parent first, then the peers in a random order, then fall back
+	// to the origin
+	candidates := make([]fetchCandidate, 0)
+	if parentURL, ok := getParentURL(website, asset); ok {
+		candidates = append(candidates, fetchCandidate{url: parentURL, source: sourceParent})
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, nc := range getContentLocationsFromControld(ctx, []string{key}) {
+		if nc.contentName == key {
+			for _, i := range r.Perm(len(nc.contentLocations)) {
+				candidates = append(candidates, fetchCandidate{url: nc.contentLocations[i], source: sourcePeer})
+			}
+		}
+	}
+	if originURL, ok := getOriginURL(website, asset); ok {
+		candidates = append(candidates, fetchCandidate{url: originURL, source: sourceOrigin})
+	}
+
+	timeout := viper.GetDuration("PullThrough.Timeout")
+	for _, c := range candidates {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+		if err != nil {
+			continue
+		}
+		tracing.Inject(ctx, req.Header)
+		resp, err := startDownload(req, timeout)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = errors.New("unexpected status: " + resp.Status)
+		}
+		if err != nil {
+			s.fetches.record(c.source, c.url, err)
+			log.Debug().Err(err).Str("url", c.url).Str("source", c.source).Msg("Couldn't pull asset from " + c.source)
+			continue
+		}
+		// Make room with the size it claims, it's checked again once the
+		// asset is verified
+		if resp.ContentLength >= 0 {
+			if err := s.makeRoom(website, asset, resp.ContentLength); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+
+		toDownload := filepath.Join(contentDir, website, asset)
+		if err := os.MkdirAll(filepath.Dir(toDownload), os.ModePerm); err != nil {
+			resp.Body.Close()
+			s.unreserve(website, asset)
+			return nil, err
+		}
+		out, err := ioutil.TempFile(filepath.Dir(toDownload), asset+"*_temp")
+		if err != nil {
+			resp.Body.Close()
+			s.unreserve(website, asset)
+			return nil, err
+		}
+
+		f = &pullFetch{
+			s:          s,
+			key:        key,
+			call:       call,
+			website:    website,
+			asset:      asset,
+			url:        c.url,
+			source:     c.source,
+			toDownload: toDownload,
+			body:       resp.Body,
+			out:        out,
+		}
+		f.cond = sync.NewCond(&f.mux)
+		return f, nil
+	}
+
+	return nil, ErrAssetNotFound
+}
+
+// pullFetch downloads an asset to disk and hashes it, keeping what it has so
+// far in memory for the client that asked for it to read at its own pace
+type pullFetch struct {
+	s          *State
+	key        string
+	call       *fetchCall
+	website    string
+	asset      string
+	url        string
+	source     string
+	toDownload string
+
+	body io.ReadCloser
+	out  *os.File
+
+	mux  sync.Mutex
+	cond *sync.Cond
+	data []byte
+	done bool
+	err  error
+}
+
+// run downloads the asset, then verifies and stores it
+func (f *pullFetch) run() {
+	h := sha256.New()
+	buf := make([]byte, 32*1024)
+	var err error
+	for {
+		n, rerr := f.body.Read(buf)
+		if n > 0 {
+			if _, werr := f.out.Write(buf[:n]); werr != nil && rerr == nil {
+				rerr = werr
+			}
+			h.Write(buf[:n])
+			f.mux.Lock()
+			f.data = append(f.data, buf[:n]...)
+			f.cond.Broadcast()
+			f.mux.Unlock()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	f.body.Close()
+	f.out.Close()
+
+	if err == nil {
+		err = verifyHash(h.Sum(nil), f.asset)
+	}
+	if err == nil {
+		err = f.s.makeRoom(f.website, f.asset, int64(len(f.data)))
+	}
+	if err == nil {
+		err = os.Rename(f.out.Name(), f.toDownload)
+	}
+	f.s.fetches.record(f.source, f.url, err)
+
+	if err != nil {
+		os.Remove(f.out.Name())
+		f.s.unreserve(f.website, f.asset)
+		log.Warn().
+			Str("url", f.url).
+			Str("filename", f.key).
+			Str("source", f.source).
+			Err(err).
+			Msg("Error pulling file from " + f.source)
+	} else {
+		f.s.addAsset(f.website, f.asset, f.data)
+		f.s.markVerified(f.key)
+		if f.source == sourceOrigin {
+			log.Info().
+				Str("url", f.url).
+				Str("filename", f.key).
+				Msg("Pulled asset from the website origin")
+		} else {
+			log.Debug().
+				Str("url", f.url).
+				Str("filename", f.key).
+				Str("path", f.toDownload).
+				Msg("A new file was pulled from a peer")
+		}
+	}
+
+	f.mux.Lock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.mux.Unlock()
+	f.s.websites.release(f.website)
+	f.s.pulls.finish(f.key, f.call, err)
+}
+
+// pullReader streams a pull to the client that started it, an asset that
+// fails verification ends the stream with an error
+type pullReader struct {
+	f   *pullFetch
+	off int
+}
+
+func (r *pullReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for r.off >= len(f.data) && !f.done {
+		f.cond.Wait()
+	}
+	if r.off < len(f.data) {
+		n := copy(p, f.data[r.off:])
+		r.off += n
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+// Close lets the client go, the download carries on without it
+func (r *pullReader) Close() error {
+	return nil
+}
+
+// validContentName makes sure a website or asset name can't escape the content
+// directory
+func validContentName(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`) &&
+		!strings.HasSuffix(name, "_temp")
+}
@@ -0,0 +1,383 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestLocations points the network gateway at a server that tells us the
+// peers holding each piece of content
+func newTestLocations(t *testing.T, locations map[string][]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/p2p/state/content_links" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"response": locations})
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	viper.Set("NetworkGatewayProtocol", "http")
+	viper.Set("NetworkGatewayHostname", host)
+	viper.Set("NetworkGatewayPort", port)
+}
+
+func TestPullThroughCoalesces(t *testing.T) {
+	viper.Set("PullThrough.NegativeCacheTTL", time.Minute)
+	viper.Set("PullThrough.MaxInFlight", 2)
+	defer viper.Reset()
+
+	p := newPullThrough()
+	call, leader, err := p.start("site/a")
+	if err != nil || !leader {
+		t.Fatalf("first start: leader = %v, err = %v", leader, err)
+	}
+	follower, leader, err := p.start("site/a")
+	if err != nil || leader || follower != call {
+		t.Fatalf("second start: leader = %v, err = %v, same call = %v", leader, err, follower == call)
+	}
+	if _, _, err := p.start("site/b"); err != nil {
+		t.Fatalf("start under the in flight limit: %v", err)
+	}
+	if _, _, err := p.start("site/c"); err != ErrAssetNotFound {
+		t.Fatalf("start over the in flight limit: err = %v, want ErrAssetNotFound", err)
+	}
+
+	p.finish("site/a", call, errors.New("nobody has it"))
+	<-call.done
+	if call.err == nil {
+		t.Fatal("waiters didn't get the error")
+	}
+	if _, _, err := p.start("site/a"); err != ErrAssetNotFound {
+		t.Fatalf("start after a miss: err = %v, want ErrAssetNotFound", err)
+	}
+}
+
+func TestPullThroughMisses(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		expired int
+		live    int
+		want    int
+	}{
+		{"under the cap", 10, 0, 3, 4},
+		{"expired misses are swept first", 5, 5, 0, 1},
+		{"full of live misses drops one", 5, 0, 5, 5},
+		{"no cap", 0, 3, 20, 24},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("PullThrough.NegativeCacheTTL", time.Minute)
+			viper.Set("PullThrough.MaxMisses", tt.max)
+			defer viper.Reset()
+
+			now := time.Now()
+			p := newPullThrough()
+			for i := 0; i < tt.expired; i++ {
+				p.misses["site/expired"+strconv.Itoa(i)] = now.Add(-time.Second)
+			}
+			for i := 0; i < tt.live; i++ {
+				p.misses["site/live"+strconv.Itoa(i)] = now.Add(time.Minute)
+			}
+
+			p.addMiss("site/new", now)
+			if len(p.misses) != tt.want {
+				t.Errorf("misses = %d, want %d", len(p.misses), tt.want)
+			}
+			if _, ok := p.misses["site/new"]; !ok {
+				t.Error("the new miss wasn't remembered")
+			}
+		})
+	}
+}
+
+func TestPullThroughSweep(t *testing.T) {
+	now := time.Now()
+	p := newPullThrough()
+	p.misses["site/old"] = now.Add(-time.Second)
+	p.misses["site/now"] = now
+	p.misses["site/later"] = now.Add(time.Second)
+
+	p.sweep(now)
+	if len(p.misses) != 1 {
+		t.Fatalf("misses = %v, want only site/later", p.misses)
+	}
+	if _, ok := p.misses["site/later"]; !ok {
+		t.Fatal("a miss that hasn't expired was swept")
+	}
+}
+
+func TestPullReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		err     error
+		want    string
+		wantErr bool
+	}{
+		{"whole asset", []string{"hello ", "world"}, nil, "hello world", false},
+		{"empty asset", nil, nil, "", false},
+		{"failed verification", []string{"corrupt"}, errors.New("hash mismatch"), "corrupt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &pullFetch{}
+			f.cond = sync.NewCond(&f.mux)
+
+			// The download keeps going at its own pace while we read
+			go func() {
+				for _, c := range tt.chunks {
+					f.mux.Lock()
+					f.data = append(f.data, c...)
+					f.cond.Broadcast()
+					f.mux.Unlock()
+				}
+				f.mux.Lock()
+				f.done = true
+				f.err = tt.err
+				f.cond.Broadcast()
+				f.mux.Unlock()
+			}()
+
+			r := &pullReader{f: f}
+			b, err := ioutil.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(b) != tt.want {
+				t.Errorf("read %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullReaderDoesNotBlockFetch(t *testing.T) {
+	f := &pullFetch{}
+	f.cond = sync.NewCond(&f.mux)
+	r := &pullReader{f: f}
+
+	// Nobody reads, but the download still finishes
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			f.mux.Lock()
+			f.data = append(f.data, make([]byte, 32*1024)...)
+			f.cond.Broadcast()
+			f.mux.Unlock()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download waited on the reader")
+	}
+
+	f.mux.Lock()
+	f.done = true
+	f.cond.Broadcast()
+	f.mux.Unlock()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil || n != 100*32*1024 {
+		t.Fatalf("read %d bytes, err = %v", n, err)
+	}
+}
+
+func TestPullAsset(t *testing.T) {
+	data := []byte("pulled asset")
+	asset := hashName(data)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		lazy    bool
+		website string
+		body    []byte
+		wantErr bool
+	}{
+		{"from a peer", true, false, "site", data, false},
+		{"from a peer loading lazily", true, true, "site", data, false},
+		{"disabled", false, false, "site", data, true},
+		{"invalid website", true, false, "..", data, true},
+		{"peer sends the wrong asset", true, false, "site", []byte("corrupt"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			viper.Set("PullThrough.Enabled", tt.enabled)
+			viper.Set("PullThrough.Timeout", time.Minute)
+			viper.Set("PullThrough.NegativeCacheTTL", time.Minute)
+			viper.Set("Index.LazyLoad", tt.lazy)
+
+			peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tt.body)
+			}))
+			defer peer.Close()
+			newTestLocations(t, map[string][]string{tt.website + "/" + asset: {peer.URL}})
+
+			r, size, err := s.PullAsset(context.Background(), tt.website, asset)
+			if err == nil {
+				if size != -1 {
+					t.Errorf("size = %d before the download is done, want -1", size)
+				}
+				var b []byte
+				b, err = ioutil.ReadAll(r)
+				if closeErr := r.Close(); err == nil {
+					err = closeErr
+				}
+				if err == nil && string(b) != string(data) {
+					t.Errorf("streamed %q", b)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			contentDir, _ := getContentDir()
+			_, statErr := os.Stat(filepath.Join(contentDir, tt.website, asset))
+			if stored := statErr == nil && s.GetAsset(tt.website, asset) != nil; stored == tt.wantErr {
+				t.Errorf("stored = %v after pulling", stored)
+			}
+			if inMemory := s.loadedAsset(tt.website, asset) != nil; !tt.wantErr && inMemory == tt.lazy {
+				t.Errorf("in memory = %v, lazy = %v", inMemory, tt.lazy)
+			}
+		})
+	}
+}
+
+func TestPullAssetNoRoom(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("PullThrough.Enabled", true)
+	viper.Set("PullThrough.Timeout", time.Minute)
+	viper.Set("PullThrough.NegativeCacheTTL", time.Minute)
+	viper.Set("Storage.MaxBytes", "5")
+
+	data := []byte("larger than the budget")
+	asset := hashName(data)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer peer.Close()
+	newTestLocations(t, map[string][]string{"site/" + asset: {peer.URL}})
+
+	// The size the peer sends up front is enough to turn it down
+	if _, _, err := s.PullAsset(context.Background(), "site", asset); err == nil {
+		t.Fatal("pulled an asset that doesn't fit")
+	}
+	contentDir, _ := getContentDir()
+	if files, _ := ioutil.ReadDir(filepath.Join(contentDir, "site")); len(files) > 0 {
+		t.Errorf("%d files left in the website directory", len(files))
+	}
+	if s.content.getWebsite("site") != nil && s.content.getWebsite("site").getAsset(asset) != nil {
+		t.Error("room is still reserved for the asset")
+	}
+}
+
+func TestPullAssetTracing(t *testing.T) {
+	s := newTestState(t)
+	exporter := newTestExporter(t)
+	viper.Set("PullThrough.Enabled", true)
+	viper.Set("PullThrough.Timeout", time.Minute)
+
+	data := []byte("traced asset")
+	asset := hashName(data)
+	traceparent := make(chan string, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.Write(data)
+	}))
+	defer peer.Close()
+	newTestLocations(t, map[string][]string{"site/" + asset: {peer.URL}})
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "HTTP /content")
+	r, _, err := s.PullAsset(ctx, "site", asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	parent.End()
+
+	traceID := parent.SpanContext().TraceID()
+	if got := <-traceparent; !strings.Contains(got, traceID.String()) {
+		t.Errorf("peer got traceparent %q, want trace %v", got, traceID)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID() != traceID {
+			t.Errorf("span %q isn't part of the request's trace", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	tests := []struct {
+		span  string
+		attrs map[attribute.Key]string
+	}{
+		{"pull_through", map[attribute.Key]string{"content.name": "site/" + asset, "content.source": sourcePeer, "url.full": peer.URL}},
+		{"content_links", nil},
+		{"gateway /p2p/state/content_links", nil},
+	}
+	for _, tt := range tests {
+		span, ok := spans[tt.span]
+		if !ok {
+			t.Errorf("no %q span in %v", tt.span, exporter.GetSpans())
+			continue
+		}
+		for key, want := range tt.attrs {
+			if got := spanAttribute(span, key); got != want {
+				t.Errorf("%s %s = %q, want %q", tt.span, key, got, want)
+			}
+		}
+	}
+	if spans["pull_through"].Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("pull_through isn't a child of the request")
+	}
+	if spans["gateway /p2p/state/content_links"].Parent.SpanID() != spans["content_links"].SpanContext.SpanID() {
+		t.Error("the gateway call isn't a child of content_links")
+	}
+}
+
+func TestValidContentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"templates.example.com", true},
+		{hashName([]byte("asset")), true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"asset_temp", false},
+	}
+	for _, tt := range tests {
+		if got := validContentName(tt.name); got != tt.want {
+			t.Errorf("validContentName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,35 +4,70 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/spf13/viper"
 
 	"github.com/buger/jsonparser"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
 	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/gladiusio/gladius-edged/edged/tracing"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // New returns a new state struct
 func New(p2pHandler *handler.P2PHandler) *State {
-	state := &State{running: true, content: &contentStore{make(map[string]*websiteContent)}, runChannel: make(chan bool), p2p: p2pHandler}
+	state := &State{running: 1, content: &contentStore{make(map[string]*websiteContent)}, runChannel: make(chan bool), p2p: p2pHandler, pulls: newPullThrough(), fetches: &fetchCounters{}, ads: newAdvertiser(), storage: newStorage(), gc: newGarbageCollector(), pins: loadPins(), tombstones: loadTombstones(), index: openIndex(), stats: newAccessStats(), syncing: newSyncControl(), publishes: make(chan struct{}, 1), websites: newWebsiteDirs(), reads: newAssetReads(), bulk: newBulkLimits(), started: time.Now()}
+	state.stats.load(state.index.loadValues(statsBucket))
 	state.startContentSyncWatcher()
 	return state
 }
 
 // State is a thread safe struct for keeping information about the edged
 type State struct {
-	p2p        *handler.P2PHandler
-	running    bool
+	p2p *handler.P2PHandler
+	// 1 until we start shutting down, read and set atomically
+	running    int32
 	content    *contentStore
 	runChannel chan (bool)
-	mux        sync.Mutex
+	pulls      *pullThrough
+	fetches    *fetchCounters
+	ads        *advertiser
+	storage    *storage
+	gc         *garbageCollector
+	pins       *pinSet
+	tombstones *tombstoneSet
+	index      *contentIndex
+	stats      *accessStats
+	syncing    *syncControl
+	publishes  chan struct{}
+	websites   *websiteDirs
+	reads      *assetReads
+	bulk       *bulkLimits
+	scans      sync.Mutex
+	// 1 once the content directory has been scanned, read and set atomically
+	scanned int32
+	started time.Time
+	cert    *CertificateStatus
+	// Sync progress, updated atomically
+	queueDepth  int64
+	downloading int64
+	// The names of the websites in content as a map[string]bool, replaced
+	// under mux whenever one is added or removed so it can be read without it
+	held atomic.Value
+	mux  sync.Mutex
 }
 
 type contentStore struct {
@@ -55,47 +90,200 @@ func (c contentStore) getWebsite(name string) *websiteContent {
 }
 
 func (c contentStore) createWebsite(name string) *websiteContent {
-	wc := &websiteContent{make(map[string][]byte)}
+	wc := &websiteContent{make(map[string]*assetContent)}
 	c.websites[name] = wc
 	return wc
 }
 
 type websiteContent struct {
-	assets map[string][]byte
+	assets map[string]*assetContent
 }
 
-func (w websiteContent) getAsset(name string) []byte {
-	return w.assets[name]
+// assetContent is an asset we have on disk, data is nil when content is
+// loaded lazily and the asset is read from disk whenever it's requested
+type assetContent struct {
+	size int64
+	data []byte
 }
 
-func (w *websiteContent) createAsset(name string, content []byte) {
-	w.assets[name] = content
+func (w websiteContent) getAsset(name string) *assetContent {
+	return w.assets[name]
 }
 
-type status struct {
-	Running bool
-	Version string
+func (w *websiteContent) createAsset(name string, size int64, content []byte) {
+	w.assets[name] = &assetContent{size: size, data: content}
 }
 
 func (s *State) GetAsset(website, asset string) []byte {
+	a, err := s.loadAsset(website, asset)
+	if err != nil {
+		log.Warn().Err(err).Str("website", website).Str("asset", asset).Msg("Error loading asset from disk")
+		return nil
+	}
+	if a != nil {
+		s.storage.touch(strings.Join([]string{website, asset}, "/"))
+	}
+	return a
+}
+
+// loadAsset returns an asset we have. Lazy assets are read from disk outside
+// the lock on every request rather than kept in memory, concurrent requests
+// for the same asset share one read. An asset that doesn't match its hash is
+// removed.
+func (s *State) loadAsset(website, asset string) ([]byte, error) {
 	s.mux.Lock()
-	// Lock so only one goroutine at a time can access the map
-	defer s.mux.Unlock()
+	data, ok := s.assetData(website, asset)
+	s.mux.Unlock()
+	if !ok || data != nil {
+		return data, nil
+	}
+
+	contentName := strings.Join([]string{website, asset}, "/")
+	return s.reads.do(contentName, func() ([]byte, error) {
+		b, verified, err := s.readAsset(website, asset, s.index.get(contentName))
+
+		s.mux.Lock()
+		// It could have been removed while we were reading it
+		_, ok := s.assetData(website, asset)
+		if ok && err != nil && !verified {
+			s.dropContent(contentName)
+		}
+		s.mux.Unlock()
+		if !ok {
+			return nil, nil
+		}
+		if err != nil {
+			if !verified {
+				s.deleteContent([]string{contentName})
+				s.advertiseContent()
+			}
+			return nil, err
+		}
+		return b, nil
+	})
+}
+
+// assetData returns the data of an asset we have, nil if it's loaded lazily.
+// The caller must hold the lock.
+func (s *State) assetData(website, asset string) ([]byte, bool) {
 	w := s.content.getWebsite(website)
-	if w != nil {
-		return w.getAsset(asset)
+	if w == nil {
+		return nil, false
+	}
+	a := w.getAsset(asset)
+	if a == nil {
+		return nil, false
+	}
+	return a.data, true
+}
+
+// assetRead is a read of a lazy asset from disk
+type assetRead struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// assetReads coalesces concurrent reads of the same asset from disk
+type assetReads struct {
+	mux      sync.Mutex
+	inFlight map[string]*assetRead
+}
+
+func newAssetReads() *assetReads {
+	return &assetReads{inFlight: make(map[string]*assetRead)}
+}
+
+// do calls read for the key, unless a read for it is already in flight in
+// which case it waits for that one and returns its result
+func (r *assetReads) do(key string, read func() ([]byte, error)) ([]byte, error) {
+	r.mux.Lock()
+	if call, ok := r.inFlight[key]; ok {
+		r.mux.Unlock()
+		<-call.done
+		return call.data, call.err
 	}
-	return nil
+	call := &assetRead{done: make(chan struct{})}
+	r.inFlight[key] = call
+	r.mux.Unlock()
+
+	call.data, call.err = read()
+
+	r.mux.Lock()
+	delete(r.inFlight, key)
+	r.mux.Unlock()
+	close(call.done)
+	return call.data, call.err
 }
 
-func (s *State) Info() string {
+// AssetListing describes an asset we have
+type AssetListing struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Pinned bool   `json:"pinned"`
+}
+
+// WebsiteListing describes a website and the assets we have of it
+type WebsiteListing struct {
+	Name   string         `json:"name"`
+	Size   int64          `json:"size"`
+	Pinned bool           `json:"pinned"`
+	Assets []AssetListing `json:"assets"`
+}
+
+// ContentListing returns every website and asset we have
+func (s *State) ContentListing() []WebsiteListing {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	status := &status{Running: s.running}
+	listing := make([]WebsiteListing, 0, len(s.content.websites))
+	for website, wc := range s.content.websites {
+		wl := WebsiteListing{Name: website, Pinned: s.pins.websitePinned(website), Assets: make([]AssetListing, 0, len(wc.assets))}
+		for asset, content := range wc.assets {
+			contentName := strings.Join([]string{website, asset}, "/")
+			wl.Assets = append(wl.Assets, AssetListing{Name: asset, Size: content.size, Pinned: s.pins.isPinned(contentName)})
+			wl.Size += content.size
+		}
+		sort.Slice(wl.Assets, func(i, j int) bool { return wl.Assets[i].Name < wl.Assets[j].Name })
+		listing = append(listing, wl)
+	}
+	sort.Slice(listing, func(i, j int) bool { return listing[i].Name < listing[j].Name })
+	return listing
+}
+
+// websitesChanged publishes the websites we hold after one was added or
+// removed, s.mux must be held
+func (s *State) websitesChanged() {
+	held := make(map[string]bool, len(s.content.websites))
+	for website := range s.content.websites {
+		held[website] = true
+	}
+	s.held.Store(held)
+}
+
+// holdsWebsite returns if we have content for the website without taking the
+// state lock
+func (s *State) holdsWebsite(website string) bool {
+	held, _ := s.held.Load().(map[string]bool)
+	return held[website]
+}
+
+// addAsset stores an asset we just fetched so it can be served right away.
+// With lazy loading on it's read from disk like the rest of our content.
+func (s *State) addAsset(website, asset string, content []byte) {
+	size := int64(len(content))
+	if viper.GetBool("Index.LazyLoad") {
+		content = nil
+	}
 
-	jsonString, _ := json.Marshal(status)
-	return string(jsonString)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w := s.content.getWebsite(website)
+	if w == nil {
+		w = s.content.createWebsite(website)
+		s.websitesChanged()
+	}
+	w.createAsset(asset, size, content)
 }
 
 type networkContent struct {
@@ -112,28 +300,94 @@ func (c *contentList) Marshal() string {
 	return string(b)
 }
 
+// contentDiff is the controld's answer to what content we need
+type contentDiff struct {
+	needed []string
+	// The controld understands content filters in place of our exact list
+	filterSupported bool
+	// Content we should remove
+	tombstones []tombstoneDirective
+}
+
+func parseContentDiff(body []byte) *contentDiff {
+	diff := &contentDiff{needed: make([]string, 0)}
+	// Get every string in the response (our needed content)
+	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		diff.needed = append(diff.needed, string(value))
+	}, "response")
+	diff.filterSupported, _ = jsonparser.GetBoolean(body, "filter_supported")
+	if tombstones, _, _, err := jsonparser.Get(body, "tombstones"); err == nil {
+		if err := json.Unmarshal(tombstones, &diff.tombstones); err != nil {
+			log.Warn().Err(err).Msg("Network gateway sent invalid tombstones")
+		}
+	}
+	return diff
+}
+
+// getNeeded asks the controld what we need, using the version of our content
+// the network already knows about if we can instead of sending the whole list
+func (s *State) getNeeded(ctx context.Context) []string {
+	ctx, span := tracing.Start(ctx, "content_diff")
+	defer span.End()
+
+	var diff *contentDiff
+	if version := s.ads.currentVersion(); version > 0 {
+		diff = getNeededByVersion(ctx, version)
+	}
+	if diff == nil {
+		// Fetch what we have on disk in a format that's understood by the controld
+		diff = getNeededFromControld(ctx, s.getContentList())
+	}
+	if diff == nil {
+		return []string{}
+	}
+	span.SetAttributes(attribute.Int("content.needed", len(diff.needed)))
+
+	s.ads.setFilterSupported(diff.filterSupported)
+	s.applyTombstones(diff.tombstones)
+	return diff.needed
+}
+
+// getNeededByVersion asks the controld what we need based on the content
+// version we have published, nil is returned if the controld doesn't know it
+func getNeededByVersion(ctx context.Context, version uint64) *contentDiff {
+	resp, err := postToControld(ctx, "/p2p/state/content_diff", `{"content_version": `+strconv.FormatUint(version, 10)+`}`)
+	if err != nil {
+		log.Warn().Err(err).Msg("Problem getting needed content list from network gateway")
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if success, err := jsonparser.GetBoolean(body, "success"); err != nil || !success {
+		return nil
+	}
+	if _, dataType, _, err := jsonparser.Get(body, "response"); err != nil || dataType != jsonparser.Array {
+		return nil
+	}
+	return parseContentDiff(body)
+}
+
 // getNeededFromControld asks the controld what we need
-func getNeededFromControld(content []string) []string {
+func getNeededFromControld(ctx context.Context, content []string) *contentDiff {
 	c := &contentList{Content: content}
-	resp, err := postToControld("/p2p/state/content_diff", c.Marshal())
+	resp, err := postToControld(ctx, "/p2p/state/content_diff", c.Marshal())
 	if err != nil {
 		log.Warn().Err(err).Msg("Problem getting needed content list from network gateway")
-		return []string{}
+		return nil
 	}
+	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
-	contentNeeded := make([]string, 0)
-	// Get every string in the response (our needed content)
-	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		contentNeeded = append(contentNeeded, string(value))
-	}, "response")
-
-	return contentNeeded
+	return parseContentDiff(body)
 }
 
 // getContentLocationsFromControld gets a list of networkContent objects
-func getContentLocationsFromControld(content []string) []*networkContent {
+func getContentLocationsFromControld(ctx context.Context, content []string) []*networkContent {
+	ctx, span := tracing.Start(ctx, "content_links", attribute.Int("content.requested", len(content)))
+	defer span.End()
+
 	c := &contentList{Content: content}
-	resp, err := postToControld("/p2p/state/content_links", c.Marshal())
+	resp, err := postToControld(ctx, "/p2p/state/content_links", c.Marshal())
 	if err != nil {
 		log.Warn().Err(err).Msg("Problem getting links for needed content from network gateway")
 		return []*networkContent{&networkContent{}}
@@ -158,10 +412,35 @@ func getContentLocationsFromControld(content []string) []*networkContent {
 	return ncList
 }
 
-func postToControld(endpoint, message string) (*http.Response, error) {
-	controldBase := viper.GetString("NetworkGatewayProtocol") + "://" + viper.GetString("NetworkGatewayHostname") + ":" + viper.GetString("NetworkGatewayPort") + "/api"
+func postToControld(ctx context.Context, endpoint, message string) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "gateway "+endpoint)
 	byteMessage := []byte(message)
-	return http.Post(controldBase+endpoint, "application/json", bytes.NewBuffer(byteMessage))
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controldURL(endpoint), bytes.NewBuffer(byteMessage))
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	metrics.ObserveGateway(endpoint, start, gatewayError(resp, err))
+	tracing.End(span, gatewayError(resp, err))
+	return resp, err
+}
+
+func gatewayError(resp *http.Response, err error) error {
+	if err == nil && resp.StatusCode >= 400 {
+		return errors.New("unexpected status: " + resp.Status)
+	}
+	return err
+}
+
+func controldURL(endpoint string) string {
+	controldBase := viper.GetString("NetworkGatewayProtocol") + "://" + viper.GetString("NetworkGatewayHostname") + ":" + viper.GetString("NetworkGatewayPort") + "/api"
+	return controldBase + endpoint
 }
 
 // getContentList returns a list of the content we have on disk in the format of:
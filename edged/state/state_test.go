@@ -0,0 +1,187 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestState returns a state with its content directory and files in a
+// temporary directory, without the watchers and sync loop New starts
+func newTestState(t *testing.T) *State {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "edged-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("ContentDirectory", filepath.Join(dir, "content"))
+	viper.Set("Index.File", "")
+	viper.Set("Pins.File", filepath.Join(dir, "pins.json"))
+	viper.Set("Tombstones.File", filepath.Join(dir, "tombstones.json"))
+	viper.Set("Tombstones.TTL", time.Hour)
+	viper.Set("Storage.EvictionPolicy", evictLRU)
+	viper.Set("Storage.EvictionCooldown", time.Hour)
+	t.Cleanup(func() {
+		viper.Reset()
+		os.RemoveAll(dir)
+	})
+
+	return &State{
+		running:    1,
+		content:    &contentStore{make(map[string]*websiteContent)},
+		p2p:        handler.New("http://127.0.0.1:0", "", "", "", ""),
+		pulls:      newPullThrough(),
+		fetches:    &fetchCounters{},
+		ads:        newAdvertiser(),
+		storage:    newStorage(),
+		gc:         newGarbageCollector(),
+		pins:       loadPins(),
+		tombstones: loadTombstones(),
+		index:      openIndex(),
+		stats:      newAccessStats(),
+		syncing:    newSyncControl(),
+		publishes:  make(chan struct{}, 1),
+		websites:   newWebsiteDirs(),
+		reads:      newAssetReads(),
+		bulk:       newBulkLimits(),
+		started:    time.Now(),
+	}
+}
+
+var (
+	testExporter     = tracetest.NewInMemoryExporter()
+	testExporterOnce sync.Once
+)
+
+// newTestExporter sends spans to memory. The tracer only picks up the first
+// tracer provider that is set, so every test shares the exporter.
+func newTestExporter(t *testing.T) *tracetest.InMemoryExporter {
+	testExporterOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	testExporter.Reset()
+	return testExporter
+}
+
+// addTestAsset writes an asset named after its hash to the content directory
+// and serves it, returning its name
+func addTestAsset(t *testing.T, s *State, website string, data []byte) string {
+	t.Helper()
+	contentDir, err := getContentDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := hashName(data)
+	if err := os.MkdirAll(filepath.Join(contentDir, website), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(contentDir, website, asset), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.addAsset(website, asset, data)
+	return asset
+}
+
+func TestLoadAssetLazy(t *testing.T) {
+	tests := []struct {
+		name        string
+		onDisk      []byte
+		want        bool
+		wantRemoved bool
+	}{
+		{"matches its hash", []byte("lazy"), true, false},
+		{"corrupted on disk", []byte("corrupted"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			data := []byte("lazy")
+			asset := addTestAsset(t, s, "site", data)
+			// Loaded lazily, so it's read from disk when requested
+			s.content.getWebsite("site").createAsset(asset, int64(len(data)), nil)
+			contentDir, _ := getContentDir()
+			if err := ioutil.WriteFile(filepath.Join(contentDir, "site", asset), tt.onDisk, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := s.GetAsset("site", asset); (got != nil) != tt.want {
+				t.Fatalf("got %q, want it served %v", got, tt.want)
+			}
+			if removed := s.content.getWebsite("site").getAsset(asset) == nil; removed != tt.wantRemoved {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+			if a := s.content.getWebsite("site").getAsset(asset); a != nil && a.data != nil {
+				t.Error("lazy asset was kept in memory")
+			}
+		})
+	}
+}
+
+// spanAttribute returns an attribute of a span as a string
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// published returns true if a content update was queued, clearing it
+func published(s *State) bool {
+	select {
+	case <-s.publishes:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAssetReadsCoalesce(t *testing.T) {
+	r := newAssetReads()
+	release := make(chan struct{})
+	var reads int32
+	read := func() ([]byte, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return []byte("data"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := r.do("site/asset", read); err != nil || string(b) != "data" {
+				t.Errorf("got %q, %v", b, err)
+			}
+		}()
+	}
+	// Wait for the first read to start and the rest to queue up behind it
+	for atomic.LoadInt32(&reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if reads != 1 {
+		t.Errorf("read %d times, want once", reads)
+	}
+	if _, err := r.do("site/asset", func() ([]byte, error) { return nil, nil }); err != nil || len(r.inFlight) != 0 {
+		t.Error("finished reads weren't cleared")
+	}
+}
@@ -0,0 +1,490 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// statsWindow is how far back the per minute counters go
+const statsWindow = 24 * time.Hour
+
+// TrafficCounters is what we served, hits are requests for content we had and
+// misses are the rest (pulled through or not found)
+type TrafficCounters struct {
+	Requests uint64         `json:"requests"`
+	Bytes    uint64         `json:"bytes"`
+	Hits     uint64         `json:"hits"`
+	Misses   uint64         `json:"misses"`
+	Status   map[int]uint64 `json:"status"`
+}
+
+func newTrafficCounters() *TrafficCounters {
+	return &TrafficCounters{Status: make(map[int]uint64)}
+}
+
+func (c *TrafficCounters) add(status int, bytes int64, hit bool) {
+	c.Requests++
+	if bytes > 0 {
+		c.Bytes += uint64(bytes)
+	}
+	if hit {
+		c.Hits++
+	} else {
+		c.Misses++
+	}
+	c.Status[status]++
+}
+
+func (c *TrafficCounters) merge(o *TrafficCounters) {
+	c.Requests += o.Requests
+	c.Bytes += o.Bytes
+	c.Hits += o.Hits
+	c.Misses += o.Misses
+	for status, count := range o.Status {
+		c.Status[status] += count
+	}
+}
+
+func (c *TrafficCounters) copy() *TrafficCounters {
+	cp := newTrafficCounters()
+	cp.merge(c)
+	return cp
+}
+
+// websiteTraffic is the traffic of a website and each of its assets
+type websiteTraffic struct {
+	Total  *TrafficCounters            `json:"total"`
+	Assets map[string]*TrafficCounters `json:"assets"`
+}
+
+func newWebsiteTraffic() *websiteTraffic {
+	return &websiteTraffic{Total: newTrafficCounters(), Assets: make(map[string]*TrafficCounters)}
+}
+
+// trafficMinute is the traffic of one minute, kept for the time windows
+type trafficMinute struct {
+	start    time.Time
+	total    *TrafficCounters
+	websites map[string]*TrafficCounters
+}
+
+// persistedStats is what's flushed to the index under statsKey, each website
+// and asset has a key of its own so a flush only writes what changed. Websites
+// is only read, from indexes written before that.
+type persistedStats struct {
+	Since    time.Time                  `json:"since"`
+	Total    *TrafficCounters           `json:"total"`
+	Websites map[string]*websiteTraffic `json:"websites,omitempty"`
+}
+
+// Keys of the website and asset counters in the stats bucket
+const (
+	websiteStatsPrefix = "w:"
+	assetStatsPrefix   = "a:"
+)
+
+func websiteStatsKey(website string) string {
+	return websiteStatsPrefix + website
+}
+
+func assetStatsKey(website, asset string) string {
+	return assetStatsPrefix + strings.Join([]string{website, asset}, "/")
+}
+
+// accessStats aggregates what the content server serves in memory, the
+// totals are flushed to the index so they survive restarts
+type accessStats struct {
+	mux      sync.Mutex
+	since    time.Time
+	total    *TrafficCounters
+	websites map[string]*websiteTraffic
+	minutes  []*trafficMinute
+	// Website and asset keys changed since the last flush
+	dirty map[string]bool
+	// The last minute saved to the time series
+	rolledUp time.Time
+}
+
+func newAccessStats() *accessStats {
+	return &accessStats{since: time.Now(), total: newTrafficCounters(), websites: make(map[string]*websiteTraffic), dirty: make(map[string]bool)}
+}
+
+// load restores the counters flushed by a previous run
+func (a *accessStats) load(values map[string][]byte) {
+	b, ok := values[string(statsKey)]
+	if !ok {
+		return
+	}
+	p := &persistedStats{}
+	if err := json.Unmarshal(b, p); err != nil || p.Total == nil {
+		log.Warn().Err(err).Msg("Saved access stats are corrupted, starting from zero")
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.since, a.total = p.Since, p.Total
+	// Move counters saved as one value to keys of their own
+	for website, wt := range p.Websites {
+		a.websites[website] = wt
+		a.dirty[websiteStatsKey(website)] = true
+		for asset := range wt.Assets {
+			a.dirty[assetStatsKey(website, asset)] = true
+		}
+	}
+
+	for key, v := range values {
+		c := newTrafficCounters()
+		if key == string(statsKey) || json.Unmarshal(v, c) != nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(key, websiteStatsPrefix):
+			a.websiteTraffic(strings.TrimPrefix(key, websiteStatsPrefix)).Total = c
+		case strings.HasPrefix(key, assetStatsPrefix):
+			if website, asset, ok := splitContentName(strings.TrimPrefix(key, assetStatsPrefix)); ok {
+				a.websiteTraffic(website).Assets[asset] = c
+			}
+		}
+	}
+}
+
+// websiteTraffic returns the counters of a website, creating them if needed.
+// The caller must hold the lock.
+func (a *accessStats) websiteTraffic(website string) *websiteTraffic {
+	wt, ok := a.websites[website]
+	if !ok {
+		wt = newWebsiteTraffic()
+		a.websites[website] = wt
+	}
+	return wt
+}
+
+// changes returns the totals and every website and asset key changed since
+// the last call, keys that were dropped have a nil value
+func (a *accessStats) changes() (map[string][]byte, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	values := make(map[string][]byte, len(a.dirty)+1)
+	b, err := json.Marshal(&persistedStats{Since: a.since, Total: a.total})
+	if err != nil {
+		return nil, err
+	}
+	values[string(statsKey)] = b
+
+	for key := range a.dirty {
+		var c *TrafficCounters
+		switch {
+		case strings.HasPrefix(key, websiteStatsPrefix):
+			if wt, ok := a.websites[strings.TrimPrefix(key, websiteStatsPrefix)]; ok {
+				c = wt.Total
+			}
+		case strings.HasPrefix(key, assetStatsPrefix):
+			if website, asset, ok := splitContentName(strings.TrimPrefix(key, assetStatsPrefix)); ok {
+				if wt, ok := a.websites[website]; ok {
+					c = wt.Assets[asset]
+				}
+			}
+		}
+
+		values[key] = nil
+		if c != nil {
+			if values[key], err = json.Marshal(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	a.dirty = make(map[string]bool)
+	return values, nil
+}
+
+// markDirty flags keys that have to be written again, after a failed flush
+func (a *accessStats) markDirty(values map[string][]byte) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for key := range values {
+		if key != string(statsKey) {
+			a.dirty[key] = true
+		}
+	}
+}
+
+// forget drops the counters of an asset we no longer have
+func (a *accessStats) forget(contentName string) {
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if wt, ok := a.websites[website]; ok {
+		if _, ok := wt.Assets[asset]; ok {
+			delete(wt.Assets, asset)
+			a.dirty[assetStatsKey(website, asset)] = true
+		}
+	}
+}
+
+// minute returns the counters of the current minute, dropping the ones that
+// fell out of the window. The caller must hold the lock.
+func (a *accessStats) minute(now time.Time) *trafficMinute {
+	start := now.Truncate(time.Minute)
+	if n := len(a.minutes); n > 0 && a.minutes[n-1].start.Equal(start) {
+		return a.minutes[n-1]
+	}
+
+	kept := a.minutes[:0]
+	for _, m := range a.minutes {
+		if now.Sub(m.start) < statsWindow {
+			kept = append(kept, m)
+		}
+	}
+	m := &trafficMinute{start: start, total: newTrafficCounters(), websites: make(map[string]*TrafficCounters)}
+	a.minutes = append(kept, m)
+	return m
+}
+
+func (a *accessStats) record(website, asset string, status int, bytes int64, hit bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.total.add(status, bytes, hit)
+	m := a.minute(time.Now())
+	m.total.add(status, bytes, hit)
+
+	// Only content that exists gets its own counters, otherwise anyone could
+	// grow them without bound with made up names
+	if status >= 400 || !validContentName(website) || !validContentName(asset) {
+		return
+	}
+	wt := a.websiteTraffic(website)
+	wt.Total.add(status, bytes, hit)
+	ac, ok := wt.Assets[asset]
+	if !ok {
+		ac = newTrafficCounters()
+		wt.Assets[asset] = ac
+	}
+	ac.add(status, bytes, hit)
+	a.dirty[websiteStatsKey(website)] = true
+	a.dirty[assetStatsKey(website, asset)] = true
+
+	mw, ok := m.websites[website]
+	if !ok {
+		mw = newTrafficCounters()
+		m.websites[website] = mw
+	}
+	mw.add(status, bytes, hit)
+}
+
+// reset clears the counters of a website, or all of them if website is empty
+func (a *accessStats) reset(website string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for name, wt := range a.websites {
+		if website != "" && name != website {
+			continue
+		}
+		a.dirty[websiteStatsKey(name)] = true
+		for asset := range wt.Assets {
+			a.dirty[assetStatsKey(name, asset)] = true
+		}
+	}
+
+	if website != "" {
+		delete(a.websites, website)
+		for _, m := range a.minutes {
+			delete(m.websites, website)
+		}
+		return
+	}
+	a.since = time.Now()
+	a.total = newTrafficCounters()
+	a.websites = make(map[string]*websiteTraffic)
+	a.minutes = nil
+}
+
+// AssetTraffic is the traffic of a single asset
+type AssetTraffic struct {
+	Website string `json:"website"`
+	Asset   string `json:"asset"`
+	*TrafficCounters
+}
+
+// WindowTraffic is the traffic over the last Duration
+type WindowTraffic struct {
+	Duration string                      `json:"duration"`
+	Total    *TrafficCounters            `json:"total"`
+	Websites map[string]*TrafficCounters `json:"websites"`
+}
+
+// Stats is a report of what this node has served
+type Stats struct {
+	Since     time.Time                   `json:"since"`
+	Total     *TrafficCounters            `json:"total"`
+	Websites  map[string]*TrafficCounters `json:"websites"`
+	TopAssets []AssetTraffic              `json:"top_assets"`
+	Window    *WindowTraffic              `json:"window,omitempty"`
+}
+
+// StatsQuery picks what goes into a stats report. Website limits it to one
+// website, Top is the number of assets to list ranked by SortBy ("requests"
+// or "bytes") and a non zero Window adds totals for the last Window (up to 24
+// hours).
+type StatsQuery struct {
+	Website string
+	Top     int
+	SortBy  string
+	Window  time.Duration
+}
+
+// RecordRequest records a request to the content server
+func (s *State) RecordRequest(website, asset string, status int, bytes int64, hit bool) {
+	s.stats.record(website, asset, status, bytes, hit)
+
+	label := s.MetricsWebsite(website, status)
+	if bytes > 0 {
+		metrics.BytesServed.WithLabelValues(label).Add(float64(bytes))
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.CacheRequests.WithLabelValues(label, result).Inc()
+}
+
+// MetricsWebsite is the website label for a content request, only requests
+// that succeeded for a website we hold get one so made up websites can't blow
+// up the number of series. It doesn't take the state lock, it's called a few
+// times for every request.
+func (s *State) MetricsWebsite(website string, status int) string {
+	if status >= 400 || !s.holdsWebsite(website) {
+		return ""
+	}
+	return website
+}
+
+// DiskUsage returns the bytes each website uses on disk
+func (s *State) DiskUsage() map[string]int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	usage := make(map[string]int64)
+	for website, u := range s.storageStatus().Websites {
+		usage[website] = u.UsedBytes
+	}
+	return usage
+}
+
+// Stats reports what this node has served
+func (s *State) Stats(q StatsQuery) (*Stats, error) {
+	if q.Window < 0 || q.Window > statsWindow {
+		return nil, errors.New("window must be between 0 and 24h")
+	}
+	if q.SortBy == "" {
+		q.SortBy = "requests"
+	}
+	if q.SortBy != "requests" && q.SortBy != "bytes" {
+		return nil, errors.New("sort must be requests or bytes")
+	}
+
+	a := s.stats
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	report := &Stats{Since: a.since, Total: a.total.copy(), Websites: make(map[string]*TrafficCounters), TopAssets: make([]AssetTraffic, 0)}
+	for website, wt := range a.websites {
+		if q.Website != "" && website != q.Website {
+			continue
+		}
+		report.Websites[website] = wt.Total.copy()
+		for asset, c := range wt.Assets {
+			report.TopAssets = append(report.TopAssets, AssetTraffic{Website: website, Asset: asset, TrafficCounters: c.copy()})
+		}
+	}
+	if q.Website != "" {
+		report.Total = newTrafficCounters()
+		if c, ok := report.Websites[q.Website]; ok {
+			report.Total.merge(c)
+		}
+	}
+
+	sort.Slice(report.TopAssets, func(i, j int) bool {
+		ai, aj := report.TopAssets[i], report.TopAssets[j]
+		if q.SortBy == "bytes" && ai.Bytes != aj.Bytes {
+			return ai.Bytes > aj.Bytes
+		}
+		if ai.Requests != aj.Requests {
+			return ai.Requests > aj.Requests
+		}
+		return strings.Join([]string{ai.Website, ai.Asset}, "/") < strings.Join([]string{aj.Website, aj.Asset}, "/")
+	})
+	if q.Top >= 0 && len(report.TopAssets) > q.Top {
+		report.TopAssets = report.TopAssets[:q.Top]
+	}
+
+	if q.Window > 0 {
+		w := &WindowTraffic{Duration: q.Window.String(), Total: newTrafficCounters(), Websites: make(map[string]*TrafficCounters)}
+		cutoff := time.Now().Add(-q.Window)
+		for _, m := range a.minutes {
+			if m.start.Add(time.Minute).Before(cutoff) {
+				continue
+			}
+			for website, c := range m.websites {
+				if q.Website != "" && website != q.Website {
+					continue
+				}
+				if _, ok := w.Websites[website]; !ok {
+					w.Websites[website] = newTrafficCounters()
+				}
+				w.Websites[website].merge(c)
+			}
+			if q.Website == "" {
+				w.Total.merge(m.total)
+			} else if c, ok := m.websites[q.Website]; ok {
+				w.Total.merge(c)
+			}
+		}
+		report.Window = w
+	}
+	return report, nil
+}
+
+// ResetStats clears the counters of a website, or every counter if website is
+// empty
+func (s *State) ResetStats(website string) {
+	s.stats.reset(website)
+	s.flushStats()
+	log.Info().Str("website", website).Msg("Reset access stats")
+}
+
+func (s *State) flushStats() {
+	values, err := s.stats.changes()
+	if err != nil {
+		log.Warn().Err(err).Msg("Error saving access stats")
+		return
+	}
+	if err := s.index.putValues(statsBucket, values); err != nil {
+		log.Warn().Err(err).Msg("Error saving access stats")
+		s.stats.markDirty(values)
+	}
+}
+
+// startStatsFlusher periodically saves the access stats to the index
+func (s *State) startStatsFlusher() {
+	for {
+		time.Sleep(viper.GetDuration("Stats.FlushInterval"))
+		s.flushStats()
+	}
+}
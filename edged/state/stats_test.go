@@ -0,0 +1,200 @@
+package state
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestIndex opens a content index backed by a file in the test's content
+// directory
+func newTestIndex(t *testing.T, s *State) {
+	t.Helper()
+	viper.Set("Index.File", filepath.Join(filepath.Dir(viper.GetString("ContentDirectory")), "index.db"))
+	s.index = openIndex()
+	if s.index.err != nil {
+		t.Fatal(s.index.err)
+	}
+	t.Cleanup(func() { s.index.db.Close() })
+}
+
+func TestStats(t *testing.T) {
+	s := newTestState(t)
+	s.RecordRequest("site", "a", 200, 10, true)
+	s.RecordRequest("site", "a", 200, 10, true)
+	s.RecordRequest("site", "b", 200, 50, false)
+	s.RecordRequest("other", "c", 200, 5, true)
+	s.RecordRequest("made-up", "asset", 404, 0, false)
+
+	tests := []struct {
+		name     string
+		query    StatsQuery
+		requests uint64
+		top      []string
+		wantErr  bool
+	}{
+		{"everything", StatsQuery{Top: 10}, 5, []string{"a", "c", "b"}, false},
+		{"by bytes", StatsQuery{Top: 10, SortBy: "bytes"}, 5, []string{"b", "a", "c"}, false},
+		{"top asset", StatsQuery{Top: 1}, 5, []string{"a"}, false},
+		{"one website", StatsQuery{Website: "other", Top: 10}, 1, []string{"c"}, false},
+		{"last hour", StatsQuery{Top: 10, Window: time.Hour}, 5, []string{"a", "c", "b"}, false},
+		{"invalid sort", StatsQuery{SortBy: "name"}, 0, nil, true},
+		{"window too long", StatsQuery{Window: 48 * time.Hour}, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := s.Stats(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if report.Total.Requests != tt.requests {
+				t.Errorf("requests = %d, want %d", report.Total.Requests, tt.requests)
+			}
+			if len(report.TopAssets) != len(tt.top) {
+				t.Fatalf("top assets = %v, want %v", report.TopAssets, tt.top)
+			}
+			for i, asset := range tt.top {
+				if report.TopAssets[i].Asset != asset {
+					t.Errorf("top asset %d = %s, want %s", i, report.TopAssets[i].Asset, asset)
+				}
+			}
+			if tt.query.Window > 0 && (report.Window == nil || report.Window.Total.Requests != tt.requests) {
+				t.Errorf("window = %+v, want %d requests", report.Window, tt.requests)
+			}
+		})
+	}
+
+	// Requests for content we don't have only count towards the totals
+	if report, _ := s.Stats(StatsQuery{}); report.Websites["made-up"] != nil || report.Total.Status[404] != 1 {
+		t.Errorf("made up content got counters of its own: %+v", report.Websites)
+	}
+}
+
+func TestStatsFlush(t *testing.T) {
+	s := newTestState(t)
+	newTestIndex(t, s)
+
+	s.RecordRequest("site", "a", 200, 10, true)
+	s.RecordRequest("site", "a", 200, 10, true)
+	s.RecordRequest("site", "b", 200, 5, false)
+	s.RecordRequest("made-up", "asset", 404, 0, false)
+	s.flushStats()
+
+	want := []string{"a:site/a", "a:site/b", "access", "w:site"}
+	if got := statsKeys(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys = %v, want %v", got, want)
+	}
+
+	// Only what changed is written again
+	s.RecordRequest("site", "b", 200, 5, true)
+	values, err := s.stats.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values["a:site/a"] != nil {
+		t.Errorf("flushed %d keys, want the totals, the website and asset b", len(values))
+	}
+	s.index.putValues(statsBucket, values)
+
+	// Removed assets take their counters with them
+	s.stats.forget("site/a")
+	s.flushStats()
+	if got := statsKeys(s); !reflect.DeepEqual(got, []string{"a:site/b", "access", "w:site"}) {
+		t.Errorf("keys after forgetting an asset = %v", got)
+	}
+
+	restored := newAccessStats()
+	restored.load(s.index.loadValues(statsBucket))
+	wt := restored.websites["site"]
+	if restored.total.Requests != 5 || wt == nil || wt.Total.Requests != 4 || wt.Assets["b"].Requests != 2 || wt.Assets["a"] != nil {
+		t.Errorf("restored total %d, website %+v", restored.total.Requests, wt)
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	tests := []struct {
+		website string
+		want    []string
+	}{
+		{"site", []string{"a:other/b", "access", "w:other"}},
+		{"", []string{"access"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.website, func(t *testing.T) {
+			s := newTestState(t)
+			newTestIndex(t, s)
+			s.RecordRequest("site", "a", 200, 10, true)
+			s.RecordRequest("other", "b", 200, 10, true)
+			s.flushStats()
+
+			s.ResetStats(tt.website)
+			if got := statsKeys(s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsWebsite(t *testing.T) {
+	s := newTestState(t)
+	addTestAsset(t, s, "site", []byte("asset"))
+	addTestAsset(t, s, "removed", []byte("asset"))
+	if err := s.Tombstone("removed", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		website string
+		status  int
+		want    string
+	}{
+		{"site", 200, "site"},
+		{"removed", 200, ""},
+		{"site", 404, ""},
+		{"made-up", 200, ""},
+		{"../site", 200, ""},
+		{"", 200, ""},
+	}
+	for _, tt := range tests {
+		if got := s.MetricsWebsite(tt.website, tt.status); got != tt.want {
+			t.Errorf("MetricsWebsite(%q, %d) = %q, want %q", tt.website, tt.status, got, tt.want)
+		}
+	}
+}
+
+func statsKeys(s *State) []string {
+	keys := make([]string, 0)
+	for key := range s.index.loadValues(statsBucket) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestStatsLoadLegacy(t *testing.T) {
+	s := newTestState(t)
+	newTestIndex(t, s)
+
+	old := newAccessStats()
+	old.record("site", "a", 200, 10, true)
+	b, _ := json.Marshal(&persistedStats{Since: old.since, Total: old.total, Websites: old.websites})
+	s.index.putValues(statsBucket, map[string][]byte{string(statsKey): b})
+
+	s.stats.load(s.index.loadValues(statsBucket))
+	s.flushStats()
+	if got := statsKeys(s); !reflect.DeepEqual(got, []string{"a:site/a", "access", "w:site"}) {
+		t.Errorf("keys = %v, want the counters moved to keys of their own", got)
+	}
+	p := &persistedStats{}
+	json.Unmarshal(s.index.loadValues(statsBucket)[string(statsKey)], p)
+	if p.Websites != nil || p.Total.Requests != 1 {
+		t.Errorf("totals = %+v", p)
+	}
+}
@@ -0,0 +1,110 @@
+package state
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/buildinfo"
+	"github.com/gladiusio/gladius-edged/edged/metrics"
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+)
+
+// CertificateStatus describes the TLS certificate we serve content with
+type CertificateStatus struct {
+	Subject   string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	ExpiresIn string
+}
+
+type networkStatus struct {
+	handler.NetworkInfo
+	LastHeartbeat time.Time
+}
+
+type contentCounts struct {
+	Websites int
+	Assets   int
+	Bytes    int64
+}
+
+type syncStatus struct {
+	Paused            bool
+	QueueDepth        int64
+	InFlightDownloads int64
+}
+
+type status struct {
+	Running   bool
+	Version   string
+	Build     buildinfo.Info
+	StartedAt time.Time
+	Uptime    string
+	Network   networkStatus
+	Content   contentCounts
+	Sync      syncStatus
+	Gateway   metrics.GatewayState
+	TLS       *CertificateStatus
+	Fetches   fetchCounters
+	Storage   storageStatus
+}
+
+// Info returns the status of this node as JSON
+func (s *State) Info() string {
+	network := networkStatus{NetworkInfo: s.p2p.Info(), LastHeartbeat: metrics.LastHeartbeat()}
+	build := buildinfo.Get()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	st := &status{
+		Running:   s.Running(),
+		Version:   build.Version,
+		Build:     build,
+		StartedAt: s.started,
+		Uptime:    time.Since(s.started).Round(time.Second).String(),
+		Network:   network,
+		Sync: syncStatus{
+			Paused:            s.syncing.isPaused(),
+			QueueDepth:        atomic.LoadInt64(&s.queueDepth),
+			InFlightDownloads: atomic.LoadInt64(&s.downloading),
+		},
+		Gateway: metrics.Gateway(),
+		Fetches: s.fetches.snapshot(),
+		Storage: s.storageStatus(),
+	}
+	st.Content.Websites = len(s.content.websites)
+	for _, usage := range st.Storage.Websites {
+		st.Content.Assets += usage.Assets
+		st.Content.Bytes += usage.UsedBytes
+	}
+	if s.cert != nil {
+		cert := *s.cert
+		cert.ExpiresIn = time.Until(cert.NotAfter).Round(time.Second).String()
+		st.TLS = &cert
+	}
+
+	jsonString, _ := json.Marshal(st)
+	return string(jsonString)
+}
+
+// SetCertificate records the TLS certificate we serve content with
+func (s *State) SetCertificate(cert *x509.Certificate) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cert = &CertificateStatus{
+		Subject:   cert.Subject.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+}
+
+// setQueueDepth records how much content the current sync round still needs
+func (s *State) setQueueDepth(depth int64) {
+	atomic.StoreInt64(&s.queueDepth, depth)
+	metrics.SyncQueueDepth.Set(float64(depth))
+}
@@ -0,0 +1,83 @@
+package state
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/p2p/handler"
+)
+
+func TestInfo(t *testing.T) {
+	s := newTestState(t)
+	s.p2p = handler.New("http://127.0.0.1:0", "", "", "8080", "8081")
+	s.started = time.Now().Add(-time.Hour)
+	addTestAsset(t, s, "site", []byte("a"))
+	addTestAsset(t, s, "site", []byte("bc"))
+	addTestAsset(t, s, "other", []byte("def"))
+	s.PauseSync()
+	s.setQueueDepth(3)
+	s.fetches.record(sourcePeer, "http://peer:8080/content", nil)
+	s.fetches.record(sourceOrigin, "https://origin.example.com/a", errors.New("not found"))
+	notAfter := time.Now().Add(48 * time.Hour).UTC().Round(time.Second)
+	s.SetCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "node.example.com"}, DNSNames: []string{"node.example.com"}, NotAfter: notAfter})
+
+	info := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(s.Info()), &info); err != nil {
+		t.Fatal(err)
+	}
+	// field reads a value from the document by its path
+	field := func(path ...string) interface{} {
+		var v interface{} = info
+		for _, key := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[key]
+		}
+		return v
+	}
+
+	tests := []struct {
+		path []string
+		want interface{}
+	}{
+		{[]string{"Running"}, true},
+		{[]string{"Uptime"}, "1h0m0s"},
+		{[]string{"Network", "Joined"}, false},
+		{[]string{"Network", "ContentPort"}, "8080"},
+		{[]string{"Network", "HTTPPort"}, "8081"},
+		{[]string{"Content", "Websites"}, float64(2)},
+		{[]string{"Content", "Assets"}, float64(3)},
+		{[]string{"Content", "Bytes"}, float64(6)},
+		{[]string{"Sync", "Paused"}, true},
+		{[]string{"Sync", "QueueDepth"}, float64(3)},
+		{[]string{"Sync", "InFlightDownloads"}, float64(0)},
+		{[]string{"Fetches", "PeerFetches"}, float64(1)},
+		{[]string{"Fetches", "OriginFailures"}, float64(1)},
+		{[]string{"Fetches", "ParentFetches"}, float64(0)},
+		{[]string{"TLS", "Subject"}, "CN=node.example.com"},
+		{[]string{"TLS", "DNSNames"}, []interface{}{"node.example.com"}},
+		{[]string{"TLS", "NotAfter"}, notAfter.Format(time.RFC3339)},
+	}
+	for _, tt := range tests {
+		if got := field(tt.path...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+
+	// Fields that depend on the build or the clock only have to be there
+	for _, path := range [][]string{{"Version"}, {"Build", "version"}, {"Build", "go_version"}, {"StartedAt"}, {"TLS", "ExpiresIn"}, {"Gateway"}, {"Storage"}} {
+		if field(path...) == nil {
+			t.Errorf("%v is missing", path)
+		}
+	}
+	if field("Version") != field("Build", "version") {
+		t.Errorf("Version = %v, Build.version = %v", field("Version"), field("Build", "version"))
+	}
+}
@@ -0,0 +1,430 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/gladius-edged/edged/config"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Eviction policies
+const (
+	evictLRU = "lru"
+	evictLFU = "lfu"
+)
+
+// quotaConfig is the most a single website is allowed to use on disk
+type quotaConfig struct {
+	Website  string
+	MaxBytes string
+}
+
+// assetAccess is how often and how recently an asset was served
+type assetAccess struct {
+	lastAccess time.Time
+	hits       uint64
+}
+
+// storage tracks how our assets are used so we can stay within the disk
+// budget and website quotas
+type storage struct {
+	mux     sync.Mutex
+	access  map[string]*assetAccess
+	evicted map[string]time.Time
+	// Access that hasn't been saved to the index yet
+	touched map[string]bool
+	// Quotas from the config in bytes, they don't change while we run
+	quotas map[string]int64
+}
+
+func newStorage() *storage {
+	quotas, err := parseQuotas()
+	if err != nil {
+		log.Warn().Err(err).Msg("Error reading website quotas from the config, running without quotas")
+	}
+	return &storage{access: make(map[string]*assetAccess), evicted: make(map[string]time.Time), touched: make(map[string]bool), quotas: quotas}
+}
+
+// seed fills in access from the index for assets we haven't served since
+// starting. Assets that were never served count from when we first saw them,
+// so content that just arrived isn't the first to be evicted.
+func (st *storage) seed(entries map[string]*indexEntry) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	for contentName, e := range entries {
+		if _, ok := st.access[contentName]; ok {
+			continue
+		}
+		lastAccess := e.LastAccess
+		if lastAccess.IsZero() {
+			lastAccess = e.FirstSeen
+		}
+		st.access[contentName] = &assetAccess{lastAccess: lastAccess, hits: e.Hits}
+	}
+}
+
+// arrived records an asset we are downloading as accessed now, for the same
+// reason
+func (st *storage) arrived(contentName string) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	if _, ok := st.access[contentName]; !ok {
+		st.access[contentName] = &assetAccess{lastAccess: time.Now()}
+	}
+}
+
+// forget drops the access of content we no longer have
+func (st *storage) forget(contentName string) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	delete(st.access, contentName)
+	delete(st.touched, contentName)
+}
+
+// dirty returns the access of every asset served since the last call
+func (st *storage) dirty() map[string]assetAccess {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	dirty := make(map[string]assetAccess, len(st.touched))
+	for contentName := range st.touched {
+		if a, ok := st.access[contentName]; ok {
+			dirty[contentName] = *a
+		}
+	}
+	st.touched = make(map[string]bool)
+	return dirty
+}
+
+// touch records that an asset was served
+func (st *storage) touch(contentName string) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	a, ok := st.access[contentName]
+	if !ok {
+		a = &assetAccess{}
+		st.access[contentName] = a
+	}
+	a.lastAccess = time.Now()
+	a.hits++
+	st.touched[contentName] = true
+}
+
+// recentlyEvicted returns true if we evicted the content recently, the sync
+// loop leaves it alone for a while so we don't download it straight back
+func (st *storage) recentlyEvicted(contentName string) bool {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	evictedAt, ok := st.evicted[contentName]
+	if !ok {
+		return false
+	}
+	if time.Since(evictedAt) > viper.GetDuration("Storage.EvictionCooldown") {
+		delete(st.evicted, contentName)
+		return false
+	}
+	return true
+}
+
+func (st *storage) markEvicted(contentName string) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	// Forget what we evicted long enough ago that we'd download it again
+	now := time.Now()
+	cooldown := viper.GetDuration("Storage.EvictionCooldown")
+	for name, evictedAt := range st.evicted {
+		if now.Sub(evictedAt) > cooldown {
+			delete(st.evicted, name)
+		}
+	}
+
+	st.evicted[contentName] = now
+	delete(st.access, contentName)
+	delete(st.touched, contentName)
+}
+
+// less returns true if a should be evicted before b
+func (st *storage) less(a, b string) bool {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+
+	accessA, accessB := st.access[a], st.access[b]
+	if accessA == nil {
+		accessA = &assetAccess{}
+	}
+	if accessB == nil {
+		accessB = &assetAccess{}
+	}
+
+	if viper.GetString("Storage.EvictionPolicy") == evictLFU && accessA.hits != accessB.hits {
+		return accessA.hits < accessB.hits
+	}
+	return accessA.lastAccess.Before(accessB.lastAccess)
+}
+
+// parseQuotas reads the website quotas from the config
+func parseQuotas() (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	var configs []quotaConfig
+	if err := viper.UnmarshalKey("Storage.Quotas", &configs); err != nil {
+		return quotas, err
+	}
+	for _, q := range configs {
+		size, err := config.ParseBytes(q.MaxBytes)
+		if err != nil {
+			return map[string]int64{}, errors.New("invalid quota for website " + q.Website + ": " + err.Error())
+		}
+		quotas[q.Website] = size
+	}
+	return quotas, nil
+}
+
+// ValidateConfig checks the storage sizes in the config, a typo would
+// otherwise turn a limit into no limit at all
+func ValidateConfig() error {
+	if err := config.CheckBytes("Storage.MaxBytes", "Health.MinFreeDisk"); err != nil {
+		return err
+	}
+	_, err := parseQuotas()
+	return err
+}
+
+// websiteQuota returns the quota of a website in bytes, 0 if it has none
+func (st *storage) websiteQuota(website string) int64 {
+	return st.quotas[website]
+}
+
+type websiteUsage struct {
+	UsedBytes  int64
+	QuotaBytes int64
+	Assets     int
+}
+
+type storageStatus struct {
+	UsedBytes int64
+	MaxBytes  int64
+	Websites  map[string]websiteUsage
+}
+
+// storageStatus reports our disk usage against the budget and quotas, the
+// caller must hold the state lock
+func (s *State) storageStatus() storageStatus {
+	st := storageStatus{MaxBytes: config.GetBytes("Storage.MaxBytes"), Websites: make(map[string]websiteUsage)}
+	for website, wc := range s.content.websites {
+		usage := websiteUsage{QuotaBytes: s.storage.websiteQuota(website), Assets: len(wc.assets)}
+		for _, a := range wc.assets {
+			usage.UsedBytes += a.size
+		}
+		st.UsedBytes += usage.UsedBytes
+		st.Websites[website] = usage
+	}
+	return st
+}
+
+// makeRoom evicts assets until an asset of the given size fits in both the
+// website's quota and the global disk budget, then counts the asset as ours.
+// The content directory is only reloaded once a sync round settles, so
+// without that every download in the round would be checked against the
+// usage from before it.
+func (s *State) makeRoom(website, asset string, size int64) error {
+	// Evicted content is only deleted once the lock is released
+	var evicted []string
+	defer func() { s.deleteContent(evicted) }()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	maxBytes := config.GetBytes("Storage.MaxBytes")
+	quota := s.storage.websiteQuota(website)
+	if (maxBytes > 0 && size > maxBytes) || (quota > 0 && size > quota) {
+		return errors.New("asset is larger than the storage quota")
+	}
+
+	usage := s.storageStatus()
+	websiteUsed := usage.Websites[website].UsedBytes
+
+	// Replacing an asset we already have doesn't take more room
+	if wc := s.content.getWebsite(website); wc != nil {
+		if a := wc.getAsset(asset); a != nil {
+			websiteUsed -= a.size
+			usage.UsedBytes -= a.size
+		}
+	}
+
+	// Stay inside the website's quota, only evicting from that website
+	if quota > 0 && websiteUsed+size > quota {
+		freed, names := s.evict(s.evictionCandidates(website), websiteUsed+size-quota)
+		evicted = append(evicted, names...)
+		websiteUsed -= freed
+		usage.UsedBytes -= freed
+		if websiteUsed+size > quota {
+			return errors.New("not enough evictable content to stay within the website quota")
+		}
+	}
+
+	// Stay inside the global budget, evicting from any website
+	if maxBytes > 0 && usage.UsedBytes+size > maxBytes {
+		freed, names := s.evict(s.evictionCandidates(""), usage.UsedBytes+size-maxBytes)
+		evicted = append(evicted, names...)
+		if usage.UsedBytes-freed+size > maxBytes {
+			return errors.New("not enough evictable content to stay within the disk budget")
+		}
+	}
+
+	// Reserve the room, it's read from disk when first requested
+	wc := s.content.getWebsite(website)
+	if wc == nil {
+		wc = s.content.createWebsite(website)
+		s.websitesChanged()
+	}
+	if a := wc.getAsset(asset); a != nil {
+		a.size = size
+	} else {
+		wc.createAsset(asset, size, nil)
+		s.storage.arrived(strings.Join([]string{website, asset}, "/"))
+	}
+	return nil
+}
+
+// unreserve gives back the room makeRoom reserved for an asset that didn't
+// make it to disk
+func (s *State) unreserve(website, asset string) {
+	contentDir, err := getContentDir()
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(contentDir, website, asset)); !os.IsNotExist(err) {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if wc := s.content.getWebsite(website); wc != nil {
+		delete(wc.assets, asset)
+	}
+	s.storage.forget(strings.Join([]string{website, asset}, "/"))
+}
+
+// evictionCandidates returns the content of a website (or every website if
+// empty) in the order it should be evicted, the caller must hold the lock
+func (s *State) evictionCandidates(website string) []string {
+	candidates := make([]string, 0)
+	for name, wc := range s.content.websites {
+		if website != "" && name != website {
+			continue
+		}
+		for asset := range wc.assets {
+			// Pinned content is never evicted
+			contentName := strings.Join([]string{name, asset}, "/")
+			if !s.pins.isPinned(contentName) {
+				candidates = append(candidates, contentName)
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return s.storage.less(candidates[i], candidates[j])
+	})
+	return candidates
+}
+
+// evict stops serving content in order until at least the requested number of
+// bytes is freed, and returns what it evicted. The caller must hold the lock
+// and delete the evicted content with deleteContent once it releases it.
+func (s *State) evict(candidates []string, bytes int64) (int64, []string) {
+	freed := int64(0)
+	evicted := make([]string, 0)
+	for _, contentName := range candidates {
+		if freed >= bytes {
+			break
+		}
+		size := s.dropContent(contentName)
+		s.storage.markEvicted(contentName)
+		evicted = append(evicted, contentName)
+		freed += size
+		log.Info().Str("content", contentName).Int64("bytes", size).Msg("Evicted asset to stay within storage limits")
+	}
+	if freed > 0 {
+		s.advertiseContent()
+	}
+	return freed, evicted
+}
+
+// deleteContent deletes content we stopped serving from disk and the index,
+// it's called without the lock. Content that was stored again in the
+// meantime is left alone.
+func (s *State) deleteContent(contentNames []string) {
+	for _, contentName := range contentNames {
+		website, asset, ok := splitContentName(contentName)
+		if !ok {
+			continue
+		}
+		s.mux.Lock()
+		_, back := s.assetData(website, asset)
+		s.mux.Unlock()
+		if back {
+			continue
+		}
+
+		if err := s.removeContentFile(contentName); err != nil {
+			log.Warn().Err(err).Str("content", contentName).Msg("Error removing asset from disk")
+			continue
+		}
+		s.forgetContent(contentName)
+	}
+}
+
+// removeContentFile deletes content from disk, it doesn't need the lock
+func (s *State) removeContentFile(contentName string) error {
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return errors.New("invalid content name: " + contentName)
+	}
+	contentDir, err := getContentDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(contentDir, website, asset)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// dropContent stops serving content and returns its size, the caller must
+// hold the lock and remove it from disk and the index once it releases it
+func (s *State) dropContent(contentName string) int64 {
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return 0
+	}
+
+	size := int64(0)
+	if wc := s.content.getWebsite(website); wc != nil {
+		if a := wc.getAsset(asset); a != nil {
+			size = a.size
+		}
+		delete(wc.assets, asset)
+	}
+	return size
+}
+
+// forgetContent removes content we no longer have from the index and stats,
+// it doesn't need the lock
+func (s *State) forgetContent(contentNames ...string) {
+	s.index.remove(contentNames...)
+	for _, contentName := range contentNames {
+		s.stats.forget(contentName)
+	}
+}
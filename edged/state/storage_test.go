@@ -0,0 +1,284 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestMakeRoom(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBytes    string
+		quota       string
+		size        int64
+		wantErr     bool
+		wantEvicted []string
+	}{
+		{"fits", "100", "", 40, false, nil},
+		{"evicts the least recently served", "100", "", 60, false, []string{"site/old"}},
+		{"evicts as much as it needs", "100", "", 80, false, []string{"site/old", "site/new"}},
+		{"quota only evicts from the website", "", "site", 30, false, []string{"site/old"}},
+		{"larger than the budget", "100", "", 101, true, nil},
+		{"larger than the quota", "", "site", 51, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			viper.Set("Storage.MaxBytes", tt.maxBytes)
+			viper.Set("Storage.EvictionPolicy", evictLRU)
+			viper.Set("Storage.EvictionCooldown", time.Hour)
+			if tt.quota != "" {
+				s.storage.quotas = map[string]int64{tt.quota: 50}
+			}
+			s.addAsset("site", "old", make([]byte, 20))
+			s.addAsset("site", "new", make([]byte, 20))
+			s.addAsset("other", "asset", make([]byte, 20))
+			s.storage.touch("site/old")
+			s.storage.touch("site/new")
+			s.storage.touch("other/asset")
+			s.storage.access["site/old"].lastAccess = time.Now().Add(-2 * time.Hour)
+			s.storage.access["site/new"].lastAccess = time.Now().Add(-time.Hour)
+
+			err := s.makeRoom("site", hashName([]byte("incoming")), tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, name := range []string{"site/old", "site/new", "other/asset"} {
+				website, asset, _ := splitContentName(name)
+				evicted := s.content.getWebsite(website).getAsset(asset) == nil
+				wantEvicted := false
+				for _, e := range tt.wantEvicted {
+					wantEvicted = wantEvicted || e == name
+				}
+				if evicted != wantEvicted {
+					t.Errorf("%s evicted = %v, want %v", name, evicted, wantEvicted)
+				}
+				if evicted && !s.storage.recentlyEvicted(name) {
+					t.Errorf("%s would be downloaded straight back", name)
+				}
+			}
+		})
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	now := time.Now()
+	access := map[string]*assetAccess{
+		"site/old-popular": {lastAccess: now.Add(-time.Hour), hits: 100},
+		"site/new-rare":    {lastAccess: now, hits: 1},
+		"site/mid":         {lastAccess: now.Add(-time.Minute), hits: 10},
+	}
+	tests := []struct {
+		policy string
+		pinned []string
+		want   []string
+	}{
+		{evictLRU, nil, []string{"site/never", "site/old-popular", "site/mid", "site/new-rare"}},
+		{evictLFU, nil, []string{"site/never", "site/new-rare", "site/mid", "site/old-popular"}},
+		{evictLRU, []string{"site/old-popular"}, []string{"site/never", "site/mid", "site/new-rare"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" pinned "+strings.Join(tt.pinned, ","), func(t *testing.T) {
+			s := newTestState(t)
+			viper.Set("Storage.EvictionPolicy", tt.policy)
+			viper.Set("Pins.Assets", tt.pinned)
+			wc := s.content.createWebsite("site")
+			for _, name := range []string{"old-popular", "new-rare", "mid", "never"} {
+				wc.createAsset(name, 1, nil)
+			}
+			for name, a := range access {
+				copied := *a
+				s.storage.access[name] = &copied
+			}
+
+			if got := s.evictionCandidates("site"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		quotas  []map[string]string
+		want    map[string]int64
+		wantErr bool
+	}{
+		{"none", nil, map[string]int64{}, false},
+		{"sizes", []map[string]string{{"website": "a", "maxbytes": "1KB"}, {"website": "b", "maxbytes": "2MB"}}, map[string]int64{"a": 1024, "b": 2 << 20}, false},
+		{"typo", []map[string]string{{"website": "a", "maxbytes": "1K"}}, map[string]int64{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer viper.Reset()
+			viper.Set("Storage.Quotas", tt.quotas)
+
+			got, err := parseQuotas()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("quotas = %v, want %v", got, tt.want)
+			}
+			if err := ValidateConfig(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMakeRoomReserves(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes string
+		quota    string
+		sizes    []int64
+		wantErr  []bool
+		wantUsed int64
+	}{
+		{"fits", "100", "", []int64{40, 40}, []bool{false, false}, 80},
+		{"second download doesn't fit", "100", "", []int64{60, 60}, []bool{false, true}, 60},
+		{"website quota", "", "50", []int64{30, 30}, []bool{false, true}, 30},
+		{"larger than the budget", "100", "", []int64{101}, []bool{true}, 0},
+		{"no limit", "0", "", []int64{1 << 40, 1 << 40}, []bool{false, false}, 2 << 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			viper.Set("Storage.MaxBytes", tt.maxBytes)
+			if tt.quota != "" {
+				s.storage.quotas = map[string]int64{"site": 50}
+			}
+			// Everything we have is pinned so nothing can be evicted
+			viper.Set("Pins.Websites", []string{"site"})
+
+			// Nothing reloads the content directory between downloads of a round
+			for i, size := range tt.sizes {
+				err := s.makeRoom("site", hashName([]byte{byte(i)}), size)
+				if (err != nil) != tt.wantErr[i] {
+					t.Fatalf("download %d: err = %v, wantErr %v", i, err, tt.wantErr[i])
+				}
+			}
+
+			s.mux.Lock()
+			used := s.storageStatus().UsedBytes
+			s.mux.Unlock()
+			if used != tt.wantUsed {
+				t.Errorf("used %d bytes, want %d", used, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestMakeRoomEvicts(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Storage.MaxBytes", "10")
+	old := addTestAsset(t, s, "site", []byte("0123456789"))
+
+	if err := s.makeRoom("site", hashName([]byte("new")), 5); err != nil {
+		t.Fatal(err)
+	}
+	if s.content.getWebsite("site").getAsset(old) != nil {
+		t.Fatal("the old asset wasn't evicted")
+	}
+	contentDir, _ := getContentDir()
+	if _, err := os.Stat(filepath.Join(contentDir, "site", old)); !os.IsNotExist(err) {
+		t.Errorf("the evicted asset is still on disk: %v", err)
+	}
+	if !s.storage.recentlyEvicted("site/" + old) {
+		t.Error("the evicted asset would be downloaded straight back")
+	}
+	if !published(s) {
+		t.Error("the network wasn't told about the eviction")
+	}
+}
+
+func TestUnreserve(t *testing.T) {
+	s := newTestState(t)
+	kept := addTestAsset(t, s, "site", []byte("on disk"))
+	missing := hashName([]byte("never written"))
+	if err := s.makeRoom("site", missing, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	s.unreserve("site", kept)
+	s.unreserve("site", missing)
+	wc := s.content.getWebsite("site")
+	if wc.getAsset(kept) == nil {
+		t.Error("an asset on disk was unreserved")
+	}
+	if wc.getAsset(missing) != nil {
+		t.Error("the reservation of an asset that never made it to disk was kept")
+	}
+}
+
+func TestStorageSeed(t *testing.T) {
+	now := time.Now()
+	st := newStorage()
+	st.access["site/served"] = &assetAccess{lastAccess: now, hits: 3}
+	st.seed(map[string]*indexEntry{
+		"site/served":   {LastAccess: now.Add(-time.Hour), Hits: 1},
+		"site/indexed":  {FirstSeen: now.Add(-2 * time.Hour), LastAccess: now.Add(-time.Hour), Hits: 2},
+		"site/unserved": {FirstSeen: now.Add(-time.Minute)},
+	})
+
+	tests := []struct {
+		contentName string
+		want        assetAccess
+	}{
+		{"site/served", assetAccess{lastAccess: now, hits: 3}},
+		{"site/indexed", assetAccess{lastAccess: now.Add(-time.Hour), hits: 2}},
+		{"site/unserved", assetAccess{lastAccess: now.Add(-time.Minute)}},
+	}
+	for _, tt := range tests {
+		if got := st.access[tt.contentName]; got == nil || !got.lastAccess.Equal(tt.want.lastAccess) || got.hits != tt.want.hits {
+			t.Errorf("%s access = %+v, want %+v", tt.contentName, got, tt.want)
+		}
+	}
+}
+
+func TestMakeRoomCountsDownloadsAsAccessed(t *testing.T) {
+	s := newTestState(t)
+	viper.Set("Storage.MaxBytes", "10")
+	served := addTestAsset(t, s, "site", []byte("01234"))
+	s.storage.touch("site/" + served)
+	s.storage.access["site/"+served].lastAccess = time.Now().Add(-time.Hour)
+
+	// A download that nobody asked for yet is newer than what was served
+	// an hour ago
+	downloaded := hashName([]byte("downloaded"))
+	if err := s.makeRoom("site", downloaded, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.makeRoom("site", hashName([]byte("another")), 5); err != nil {
+		t.Fatal(err)
+	}
+	wc := s.content.getWebsite("site")
+	if wc.getAsset(served) != nil || wc.getAsset(downloaded) == nil {
+		t.Error("the new download was evicted before content served an hour ago")
+	}
+}
+
+func TestMarkEvictedPrunes(t *testing.T) {
+	viper.Set("Storage.EvictionCooldown", time.Hour)
+	defer viper.Reset()
+
+	st := newStorage()
+	st.evicted["site/long-ago"] = time.Now().Add(-2 * time.Hour)
+	st.evicted["site/recent"] = time.Now().Add(-time.Minute)
+	st.markEvicted("site/now")
+
+	if _, ok := st.evicted["site/long-ago"]; ok {
+		t.Error("an eviction past the cooldown was kept")
+	}
+	if len(st.evicted) != 2 {
+		t.Errorf("evicted = %v, want site/recent and site/now", st.evicted)
+	}
+}
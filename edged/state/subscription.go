@@ -0,0 +1,169 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// gatewaySubscription is a server sent events stream from the network gateway
+// that tells us when there is content we need
+type gatewaySubscription struct {
+	connected     int32
+	notifications chan []string
+	tombstones    chan []tombstoneDirective
+	// Signalled when we connect or disconnect so the sync loop can change
+	// how often it polls, and catch up on what it missed while disconnected
+	changed chan struct{}
+}
+
+func newGatewaySubscription() *gatewaySubscription {
+	return &gatewaySubscription{notifications: make(chan []string, 1), tombstones: make(chan []tombstoneDirective, 16), changed: make(chan struct{}, 1)}
+}
+
+func (g *gatewaySubscription) isConnected() bool {
+	return atomic.LoadInt32(&g.connected) == 1
+}
+
+func (g *gatewaySubscription) setConnected(connected bool) {
+	value := int32(0)
+	if connected {
+		value = 1
+	}
+	if atomic.SwapInt32(&g.connected, value) != value {
+		select {
+		case g.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run keeps us subscribed to the gateway, backing off when it fails or the
+// gateway doesn't support subscriptions
+func (g *gatewaySubscription) run() {
+	minWait := time.Second
+	maxWait := viper.GetDuration("Sync.FallbackPollInterval")
+	wait := minWait
+	for {
+		start := time.Now()
+		err := g.listen()
+		g.setConnected(false)
+
+		// Reset the back off if we were connected for a while
+		if time.Since(start) > maxWait {
+			wait = minWait
+		}
+		log.Debug().Err(err).Str("retry_in", wait.String()).Msg("Subscription to the network gateway closed, polling until it reconnects")
+
+		time.Sleep(wait)
+		wait *= 2
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+// listen reads events from the gateway until the stream closes
+func (g *gatewaySubscription) listen() error {
+	req, err := http.NewRequest(http.MethodGet, controldURL(viper.GetString("Sync.SubscribeEndpoint")), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The gateway sends events or heartbeats regularly, a stream that goes
+	// quiet for longer than the idle timeout is dead even if the connection
+	// isn't closed, so we reconnect
+	resp, err := startDownload(req, viper.GetDuration("Sync.SubscribeIdleTimeout"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("network gateway does not support subscriptions: " + resp.Status)
+	}
+
+	g.setConnected(true)
+	log.Info().Msg("Subscribed to content notifications from the network gateway")
+
+	event := ""
+	data := make([]string, 0)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends the event, keep alives don't carry one
+			if len(data) > 0 {
+				g.dispatch(event, strings.Join(data, "\n"))
+			}
+			event = ""
+			data = data[:0]
+		case strings.HasPrefix(line, ":"):
+			// Comment, used as a keep alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed by network gateway")
+}
+
+// dispatch handles a single event, content_needed events may carry the list
+// of what we need, otherwise we ask for it ourselves. tombstone events carry
+// one or more tombstones.
+func (g *gatewaySubscription) dispatch(event, data string) {
+	if event == "tombstone" {
+		var err error
+		directives := make([]tombstoneDirective, 0)
+		if strings.HasPrefix(strings.TrimSpace(data), "[") {
+			err = json.Unmarshal([]byte(data), &directives)
+		} else {
+			d := tombstoneDirective{}
+			err = json.Unmarshal([]byte(data), &d)
+			directives = append(directives, d)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Network gateway sent an invalid tombstone")
+			return
+		}
+		g.tombstones <- directives
+		return
+	}
+	if event != "" && event != "content_needed" {
+		return
+	}
+
+	contentNeeded := make([]string, 0)
+	jsonparser.ArrayEach([]byte(data), func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		contentNeeded = append(contentNeeded, string(value))
+	}, "content")
+
+	select {
+	case g.notifications <- contentNeeded:
+	default:
+		// A sync is already pending, make it ask the gateway for everything
+		select {
+		case <-g.notifications:
+		default:
+		}
+		select {
+		case g.notifications <- []string{}:
+		default:
+		}
+	}
+}
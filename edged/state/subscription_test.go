@@ -0,0 +1,202 @@
+package state
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestSubscriptionDispatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		data       string
+		needed     []string
+		tombstones int
+	}{
+		{"content list", "content_needed", `{"content": ["site/a", "site/b"]}`, []string{"site/a", "site/b"}, 0},
+		{"unnamed event", "", `{"content": ["site/a"]}`, []string{"site/a"}, 0},
+		{"just a nudge", "content_needed", `{}`, []string{}, 0},
+		{"single tombstone", "tombstone", `{"website": "site"}`, nil, 1},
+		{"tombstone list", "tombstone", `[{"website": "site"}, {"website": "other"}]`, nil, 2},
+		{"invalid tombstone", "tombstone", `{`, nil, 0},
+		{"other event", "ping", `{}`, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGatewaySubscription()
+			g.dispatch(tt.event, tt.data)
+
+			select {
+			case needed := <-g.notifications:
+				if !reflect.DeepEqual(needed, tt.needed) {
+					t.Errorf("needed = %v, want %v", needed, tt.needed)
+				}
+			default:
+				if tt.needed != nil {
+					t.Errorf("no notification, want %v", tt.needed)
+				}
+			}
+
+			select {
+			case directives := <-g.tombstones:
+				if len(directives) != tt.tombstones {
+					t.Errorf("tombstones = %d, want %d", len(directives), tt.tombstones)
+				}
+			default:
+				if tt.tombstones != 0 {
+					t.Errorf("no tombstones, want %d", tt.tombstones)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionCoalescesNotifications(t *testing.T) {
+	g := newGatewaySubscription()
+	g.dispatch("content_needed", `{"content": ["site/a"]}`)
+	g.dispatch("content_needed", `{"content": ["site/b"]}`)
+
+	// Two pending notifications become one that asks the gateway for everything
+	if needed := <-g.notifications; len(needed) != 0 {
+		t.Fatalf("needed = %v, want an empty list", needed)
+	}
+	select {
+	case needed := <-g.notifications:
+		t.Fatalf("unexpected second notification %v", needed)
+	default:
+	}
+}
+
+func TestSubscriptionListen(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep alive\nevent: content_needed\ndata: {\"content\": [\"site/a\"]}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	viper.Set("NetworkGatewayProtocol", "http")
+	viper.Set("NetworkGatewayHostname", host)
+	viper.Set("NetworkGatewayPort", port)
+	viper.Set("Sync.SubscribeEndpoint", "/events")
+	defer viper.Reset()
+
+	g := newGatewaySubscription()
+	done := make(chan error, 1)
+	go func() { done <- g.listen() }()
+
+	if needed := <-g.notifications; !reflect.DeepEqual(needed, []string{"site/a"}) {
+		t.Fatalf("needed = %v", needed)
+	}
+	if !g.isConnected() {
+		t.Error("not connected while the stream is open")
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Fatal("a closed stream should be an error")
+	}
+}
+
+func TestSubscriptionSignalsConnection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep alive\n\nevent: content_needed\ndata: {\"content\": [\"site/a\"]}\n\n")
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	viper.Set("NetworkGatewayProtocol", "http")
+	viper.Set("NetworkGatewayHostname", host)
+	viper.Set("NetworkGatewayPort", port)
+	viper.Set("Sync.SubscribeEndpoint", "/events")
+	defer viper.Reset()
+
+	g := newGatewaySubscription()
+	done := make(chan error, 1)
+	go func() {
+		err := g.listen()
+		g.setConnected(false)
+		done <- err
+	}()
+
+	select {
+	case <-g.changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connecting wasn't signalled")
+	}
+	if needed := <-g.notifications; !reflect.DeepEqual(needed, []string{"site/a"}) {
+		t.Fatalf("needed = %v", needed)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("a closed stream should be an error")
+	}
+	// Whether or not the sync loop saw the connect, it must see that we're
+	// disconnected now
+	select {
+	case <-g.changed:
+	default:
+		t.Fatal("disconnecting wasn't signalled")
+	}
+	if g.isConnected() {
+		t.Fatal("still connected after the stream closed")
+	}
+}
+
+func TestSubscriptionIdleTimeout(t *testing.T) {
+	// A gateway that goes quiet without closing the stream
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep alive\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	viper.Set("NetworkGatewayProtocol", "http")
+	viper.Set("NetworkGatewayHostname", host)
+	viper.Set("NetworkGatewayPort", port)
+	viper.Set("Sync.SubscribeEndpoint", "/events")
+	viper.Set("Sync.SubscribeIdleTimeout", 100*time.Millisecond)
+	defer viper.Reset()
+
+	g := newGatewaySubscription()
+	done := make(chan error, 1)
+	go func() { done <- g.listen() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("a dead stream should be an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("kept listening to a dead stream")
+	}
+}
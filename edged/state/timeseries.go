@@ -0,0 +1,251 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Time series resolutions
+const (
+	resolutionHour = "hour"
+	resolutionDay  = "day"
+)
+
+var (
+	hourlyBucket = []byte("hourly")
+	dailyBucket  = []byte("daily")
+)
+
+// TrafficPoint is the traffic of one hour or day starting at Start, with the
+// traffic of each website unless the series is for a single website
+type TrafficPoint struct {
+	Start    time.Time                   `json:"start"`
+	Total    *TrafficCounters            `json:"total"`
+	Websites map[string]*TrafficCounters `json:"websites,omitempty"`
+}
+
+func newTrafficPoint(start time.Time) *TrafficPoint {
+	return &TrafficPoint{Start: start, Total: newTrafficCounters(), Websites: make(map[string]*TrafficCounters)}
+}
+
+func (p *TrafficPoint) merge(o *TrafficPoint) {
+	p.Total.merge(o.Total)
+	for website, c := range o.Websites {
+		if _, ok := p.Websites[website]; !ok {
+			p.Websites[website] = newTrafficCounters()
+		}
+		p.Websites[website].merge(c)
+	}
+}
+
+// pointKey sorts points by time in the index
+func pointKey(start time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(start.Unix()))
+	return k
+}
+
+// updatePoints merges the points into the ones in the bucket
+func (ix *contentIndex) updatePoints(bucket []byte, points map[int64]*TrafficPoint) {
+	if ix.db == nil || len(points) == 0 {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, p := range points {
+			k := pointKey(p.Start)
+			merged := newTrafficPoint(p.Start)
+			if v := b.Get(k); v != nil {
+				if err := json.Unmarshal(v, merged); err != nil {
+					merged = newTrafficPoint(p.Start)
+				}
+			}
+			merged.merge(p)
+			v, err := json.Marshal(merged)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", string(bucket)).Msg("Error saving traffic time series")
+	}
+}
+
+// putPoints replaces the points in the bucket
+func (ix *contentIndex) putPoints(bucket []byte, points map[int64]*TrafficPoint) {
+	if ix.db == nil || len(points) == 0 {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for _, p := range points {
+			v, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(pointKey(p.Start), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", string(bucket)).Msg("Error saving traffic time series")
+	}
+}
+
+// points returns the points in the bucket from (inclusive) to (exclusive)
+func (ix *contentIndex) points(bucket []byte, from, to time.Time) []*TrafficPoint {
+	points := make([]*TrafficPoint, 0)
+	if ix.db == nil {
+		return points
+	}
+
+	ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		end := pointKey(to)
+		for k, v := c.Seek(pointKey(from)); k != nil && string(k) < string(end); k, v = c.Next() {
+			p := &TrafficPoint{}
+			if err := json.Unmarshal(v, p); err == nil && p.Total != nil {
+				points = append(points, p)
+			}
+		}
+		return nil
+	})
+	return points
+}
+
+// prunePoints removes the points in the bucket that start before the cutoff
+func (ix *contentIndex) prunePoints(bucket []byte, cutoff time.Time) {
+	if ix.db == nil {
+		return
+	}
+
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		end := pointKey(cutoff)
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", string(bucket)).Msg("Error pruning traffic time series")
+	}
+}
+
+// completedMinutes returns the traffic of every finished minute since the
+// last call, grouped into hours
+func (a *accessStats) completedMinutes() map[int64]*TrafficPoint {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	current := time.Now().Truncate(time.Minute)
+	hours := make(map[int64]*TrafficPoint)
+	for _, m := range a.minutes {
+		rolledUp := !a.rolledUp.IsZero() && !m.start.After(a.rolledUp)
+		if rolledUp || !m.start.Before(current) {
+			continue
+		}
+		hour := m.start.Truncate(time.Hour)
+		p, ok := hours[hour.Unix()]
+		if !ok {
+			p = newTrafficPoint(hour)
+			hours[hour.Unix()] = p
+		}
+		p.merge(&TrafficPoint{Total: m.total, Websites: m.websites})
+	}
+	a.rolledUp = current.Add(-time.Minute)
+	return hours
+}
+
+// rollUpTraffic saves the finished minutes to the hourly series, downsamples
+// the hourly series into the daily one and drops what is past retention
+func (s *State) rollUpTraffic() {
+	hours := s.stats.completedMinutes()
+	s.index.updatePoints(hourlyBucket, hours)
+
+	// Days are recomputed from the hourly points while we still have them
+	days := make(map[int64]*TrafficPoint)
+	for _, h := range hours {
+		day := startOfDay(h.Start)
+		if _, ok := days[day.Unix()]; ok {
+			continue
+		}
+		p := newTrafficPoint(day)
+		for _, hp := range s.index.points(hourlyBucket, day, day.AddDate(0, 0, 1)) {
+			p.merge(hp)
+		}
+		days[day.Unix()] = p
+	}
+	s.index.putPoints(dailyBucket, days)
+
+	now := time.Now()
+	s.index.prunePoints(hourlyBucket, now.Add(-viper.GetDuration("TimeSeries.HourlyRetention")))
+	s.index.prunePoints(dailyBucket, now.Add(-viper.GetDuration("TimeSeries.DailyRetention")))
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// startTimeSeries periodically rolls the access stats up into the hourly and
+// daily traffic time series
+func (s *State) startTimeSeries() {
+	if !viper.GetBool("TimeSeries.Enabled") {
+		return
+	}
+
+	for {
+		time.Sleep(viper.GetDuration("TimeSeries.RollupInterval"))
+		s.rollUpTraffic()
+	}
+}
+
+// TimeSeries returns the hourly or daily traffic from (inclusive) to
+// (exclusive), of a single website if website isn't empty
+func (s *State) TimeSeries(resolution, website string, from, to time.Time) ([]*TrafficPoint, error) {
+	// Include the point the range starts in
+	bucket := hourlyBucket
+	switch resolution {
+	case resolutionHour, "":
+		from = from.Truncate(time.Hour)
+	case resolutionDay:
+		bucket = dailyBucket
+		from = startOfDay(from)
+	default:
+		return nil, errors.New("resolution must be hour or day")
+	}
+	if !to.After(from) {
+		return nil, errors.New("the end of the range must be after the start")
+	}
+
+	points := s.index.points(bucket, from, to)
+	if website == "" {
+		return points, nil
+	}
+	for _, p := range points {
+		c, ok := p.Websites[website]
+		if !ok {
+			c = newTrafficCounters()
+		}
+		p.Total, p.Websites = c, nil
+	}
+	return points, nil
+}
@@ -0,0 +1,101 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// addTestMinute records traffic of a website in the minute starting at start
+func addTestMinute(s *State, start time.Time, website string, requests int) {
+	m := &trafficMinute{start: start, total: newTrafficCounters(), websites: map[string]*TrafficCounters{website: newTrafficCounters()}}
+	for i := 0; i < requests; i++ {
+		m.total.add(200, 10, true)
+		m.websites[website].add(200, 10, true)
+	}
+	s.stats.minutes = append(s.stats.minutes, m)
+}
+
+func TestRollUpTraffic(t *testing.T) {
+	s := newTestState(t)
+	newTestIndex(t, s)
+	viper.Set("TimeSeries.HourlyRetention", 72*time.Hour)
+	viper.Set("TimeSeries.DailyRetention", 30*24*time.Hour)
+
+	day := startOfDay(time.Now()).AddDate(0, 0, -2)
+	addTestMinute(s, day.Add(10*time.Hour), "a", 1)
+	addTestMinute(s, day.Add(10*time.Hour+30*time.Minute), "b", 2)
+	addTestMinute(s, day.Add(11*time.Hour), "a", 4)
+	addTestMinute(s, day.Add(11*time.Hour+time.Minute), "a", 8)
+	addTestMinute(s, day.AddDate(0, 0, 1), "b", 16)
+	s.rollUpTraffic()
+	// Minutes that were rolled up aren't counted twice
+	s.rollUpTraffic()
+
+	tests := []struct {
+		resolution string
+		website    string
+		want       map[time.Time]uint64
+	}{
+		{resolutionHour, "", map[time.Time]uint64{day.Add(10 * time.Hour): 3, day.Add(11 * time.Hour): 12, day.AddDate(0, 0, 1): 16}},
+		{resolutionHour, "a", map[time.Time]uint64{day.Add(10 * time.Hour): 1, day.Add(11 * time.Hour): 12, day.AddDate(0, 0, 1): 0}},
+		{resolutionDay, "", map[time.Time]uint64{day: 15, day.AddDate(0, 0, 1): 16}},
+		{resolutionDay, "b", map[time.Time]uint64{day: 2, day.AddDate(0, 0, 1): 16}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resolution+" "+tt.website, func(t *testing.T) {
+			points, err := s.TimeSeries(tt.resolution, tt.website, day, day.AddDate(0, 0, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(tt.want) {
+				t.Fatalf("got %d points, want %d", len(points), len(tt.want))
+			}
+			for _, p := range points {
+				if want, ok := tt.want[p.Start.UTC()]; !ok || p.Total.Requests != want {
+					t.Errorf("point at %v has %d requests, want %d", p.Start, p.Total.Requests, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRollUpTrafficRetention(t *testing.T) {
+	s := newTestState(t)
+	newTestIndex(t, s)
+	viper.Set("TimeSeries.HourlyRetention", 24*time.Hour)
+	viper.Set("TimeSeries.DailyRetention", 30*24*time.Hour)
+
+	old := startOfDay(time.Now()).AddDate(0, 0, -3)
+	addTestMinute(s, old, "a", 1)
+	s.rollUpTraffic()
+
+	if points, _ := s.TimeSeries(resolutionHour, "", old, time.Now()); len(points) != 0 {
+		t.Errorf("kept %d hourly points past retention", len(points))
+	}
+	if points, _ := s.TimeSeries(resolutionDay, "", old, time.Now()); len(points) != 1 {
+		t.Errorf("got %d daily points, want the day past hourly retention", len(points))
+	}
+}
+
+func TestTimeSeriesRange(t *testing.T) {
+	s := newTestState(t)
+	now := time.Now()
+	tests := []struct {
+		resolution string
+		from, to   time.Time
+		wantErr    bool
+	}{
+		{resolutionHour, now.Add(-time.Hour), now, false},
+		{"", now.Add(-time.Hour), now, false},
+		{resolutionDay, now.AddDate(0, 0, -1), now, false},
+		{"minute", now.Add(-time.Hour), now, true},
+		{resolutionHour, now, now.Add(-time.Hour), true},
+	}
+	for _, tt := range tests {
+		if _, err := s.TimeSeries(tt.resolution, "", tt.from, tt.to); (err != nil) != tt.wantErr {
+			t.Errorf("TimeSeries(%q, %v, %v) err = %v, wantErr %v", tt.resolution, tt.from, tt.to, err, tt.wantErr)
+		}
+	}
+}
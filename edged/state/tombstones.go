@@ -0,0 +1,210 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Tombstone marks a website (or a single asset of it when Asset is set) as
+// removed. We keep it until it expires so the sync loop doesn't download the
+// content again from peers that haven't removed it yet.
+type Tombstone struct {
+	Website string    `json:"website"`
+	Asset   string    `json:"asset,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (t Tombstone) covers(website, asset string) bool {
+	return t.Website == website && (t.Asset == "" || t.Asset == asset)
+}
+
+// tombstoneSet is every tombstone that hasn't expired yet, persisted in the
+// tombstones file so they survive restarts
+type tombstoneSet struct {
+	mux     sync.Mutex
+	entries []Tombstone
+}
+
+func loadTombstones() *tombstoneSet {
+	t := &tombstoneSet{entries: make([]Tombstone, 0)}
+
+	b, err := ioutil.ReadFile(viper.GetString("Tombstones.File"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("Error reading tombstones file, starting with no tombstones")
+		}
+		return t
+	}
+	if err := json.Unmarshal(b, &t.entries); err != nil {
+		log.Warn().Err(err).Msg("Tombstones file is corrupted, starting with no tombstones")
+	}
+	return t
+}
+
+// prune drops expired tombstones, the caller must hold the lock
+func (t *tombstoneSet) prune() {
+	now := time.Now()
+	kept := make([]Tombstone, 0, len(t.entries))
+	for _, e := range t.entries {
+		if now.Before(e.Expires) {
+			kept = append(kept, e)
+		}
+	}
+	t.entries = kept
+}
+
+// save writes the tombstones file atomically, the caller must hold the lock
+func (t *tombstoneSet) save() error {
+	b, err := json.MarshalIndent(t.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tombstonesFile := viper.GetString("Tombstones.File")
+	if err := os.MkdirAll(filepath.Dir(tombstonesFile), os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tombstonesFile+"_temp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tombstonesFile+"_temp", tombstonesFile)
+}
+
+// isTombstoned returns true if the content (<website name>/<fileName>) has
+// been removed
+func (t *tombstoneSet) isTombstoned(contentName string) bool {
+	website, asset, ok := splitContentName(contentName)
+	if !ok {
+		return false
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	now := time.Now()
+	for _, e := range t.entries {
+		if e.covers(website, asset) && now.Before(e.Expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tombstones returns every tombstone that hasn't expired
+func (s *State) Tombstones() []Tombstone {
+	s.tombstones.mux.Lock()
+	defer s.tombstones.mux.Unlock()
+
+	s.tombstones.prune()
+	return append([]Tombstone{}, s.tombstones.entries...)
+}
+
+// Tombstone removes a website (or one of its assets if asset isn't empty) from
+// this node and keeps it from coming back until the tombstone expires, a ttl
+// of 0 uses the configured default
+func (s *State) Tombstone(website, asset string, ttl time.Duration) error {
+	if !validContentName(website) || (asset != "" && !validContentName(asset)) {
+		return errors.New("invalid website or asset name")
+	}
+	if ttl <= 0 {
+		ttl = viper.GetDuration("Tombstones.TTL")
+	}
+
+	s.tombstones.mux.Lock()
+	s.tombstones.prune()
+	// Repeated tombstones only push back when they expire
+	expires := time.Now().Add(ttl)
+	changed := true
+	entries := make([]Tombstone, 0, len(s.tombstones.entries)+1)
+	for _, e := range s.tombstones.entries {
+		if e.Website != website || e.Asset != asset {
+			entries = append(entries, e)
+		} else if expires.Sub(e.Expires) < time.Minute {
+			changed = false
+		}
+	}
+	if changed {
+		s.tombstones.entries = append(entries, Tombstone{Website: website, Asset: asset, Expires: expires})
+		if err := s.tombstones.save(); err != nil {
+			log.Warn().Err(err).Msg("Error saving tombstones file")
+		}
+	}
+	s.tombstones.mux.Unlock()
+
+	// Stop serving it at once
+	s.mux.Lock()
+	removed := make([]string, 0)
+	wc := s.content.getWebsite(website)
+	if wc != nil {
+		for name := range wc.assets {
+			if asset != "" && name != asset {
+				continue
+			}
+			contentName := strings.Join([]string{website, name}, "/")
+			s.dropContent(contentName)
+			removed = append(removed, contentName)
+		}
+		if asset == "" {
+			delete(s.content.websites, website)
+			s.websitesChanged()
+		}
+	}
+	s.mux.Unlock()
+	if wc == nil || (asset != "" && len(removed) == 0) {
+		return nil
+	}
+
+	// Then remove it from disk, unless a download is writing to the website.
+	// New downloads skip tombstoned content, and the next scan of the content
+	// directory removes anything left behind.
+	deleted := s.websites.removeIfUnused(website, func() bool {
+		contentDir, err := getContentDir()
+		if err != nil {
+			return false
+		}
+		if asset == "" {
+			if err := os.RemoveAll(filepath.Join(contentDir, website)); err != nil {
+				log.Warn().Err(err).Str("website", website).Msg("Error removing tombstoned website")
+			}
+			return true
+		}
+		if err := s.removeContentFile(strings.Join([]string{website, asset}, "/")); err != nil {
+			log.Warn().Err(err).Str("website", website).Str("asset", asset).Msg("Error removing tombstoned asset")
+		}
+		return true
+	})
+	if !deleted {
+		log.Debug().Str("website", website).Str("asset", asset).Msg("Website is in use, leaving tombstoned content on disk for the next scan")
+	}
+	s.forgetContent(removed...)
+
+	log.Info().Str("website", website).Str("asset", asset).Int("removed", len(removed)).Msg("Tombstoned content")
+	s.advertiseContent()
+	return nil
+}
+
+// applyTombstones applies tombstone directives from the network gateway
+func (s *State) applyTombstones(directives []tombstoneDirective) {
+	for _, d := range directives {
+		if err := s.Tombstone(d.Website, d.Asset, time.Duration(d.TTL)*time.Second); err != nil {
+			log.Warn().Err(err).Str("website", d.Website).Str("asset", d.Asset).Msg("Ignoring invalid tombstone from the network gateway")
+		}
+	}
+}
+
+// tombstoneDirective is a tombstone sent by the network gateway, the TTL is in
+// seconds
+type tombstoneDirective struct {
+	Website string `json:"website"`
+	Asset   string `json:"asset"`
+	TTL     int64  `json:"ttl"`
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestTombstoneCovers(t *testing.T) {
+	tests := []struct {
+		name      string
+		tombstone Tombstone
+		content   string
+		want      bool
+	}{
+		{"whole website", Tombstone{Website: "site"}, "site/a", true},
+		{"that asset", Tombstone{Website: "site", Asset: "a"}, "site/a", true},
+		{"other asset", Tombstone{Website: "site", Asset: "a"}, "site/b", false},
+		{"other website", Tombstone{Website: "site"}, "other/a", false},
+		{"expired", Tombstone{Website: "site", Expires: time.Now().Add(-time.Second)}, "site/a", false},
+		{"invalid content name", Tombstone{Website: "site"}, "site", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.tombstone.Expires.IsZero() {
+				tt.tombstone.Expires = time.Now().Add(time.Hour)
+			}
+			set := &tombstoneSet{entries: []Tombstone{tt.tombstone}}
+			if got := set.isTombstoned(tt.content); got != tt.want {
+				t.Errorf("isTombstoned(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTombstoneRemovesContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		asset      bool
+		inUse      bool
+		wantLeft   int
+		wantRemove bool
+	}{
+		{"one asset", true, false, 1, true},
+		{"whole website", false, false, 0, true},
+		{"website being downloaded to", true, true, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestState(t)
+			a := addTestAsset(t, s, "site", []byte("a"))
+			addTestAsset(t, s, "site", []byte("b"))
+			if tt.inUse {
+				s.websites.acquire("site")
+			}
+
+			asset := ""
+			if tt.asset {
+				asset = a
+			}
+			if err := s.Tombstone("site", asset, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			left := 0
+			if wc := s.content.getWebsite("site"); wc != nil {
+				left = len(wc.assets)
+			}
+			if left != tt.wantLeft {
+				t.Errorf("%d assets left, want %d", left, tt.wantLeft)
+			}
+			contentDir, _ := getContentDir()
+			_, err := os.Stat(filepath.Join(contentDir, "site", a))
+			if tt.inUse {
+				// The download could be writing next to it, the next scan
+				// removes it
+				if err != nil {
+					t.Errorf("removed from a website in use: %v", err)
+				}
+				s.websites.release("site")
+				s.loadContentFromDisk()
+				_, err = os.Stat(filepath.Join(contentDir, "site", a))
+			}
+			if !os.IsNotExist(err) {
+				t.Errorf("tombstoned asset still on disk: %v", err)
+			}
+			if !s.tombstones.isTombstoned("site/" + a) {
+				t.Error("asset isn't tombstoned")
+			}
+			// Tombstones survive a restart
+			if !loadTombstones().isTombstoned("site/" + a) {
+				t.Error("tombstone wasn't saved")
+			}
+			if published(s) != tt.wantRemove {
+				t.Error("the network wasn't told about the removal")
+			}
+		})
+	}
+}
+
+func TestTombstoneExpires(t *testing.T) {
+	s := newTestState(t)
+	if err := s.Tombstone("site", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.tombstones.entries[0].Expires = time.Now().Add(-time.Second)
+	if got := s.Tombstones(); len(got) != 0 {
+		t.Errorf("expired tombstones are still listed: %v", got)
+	}
+
+	// Repeating a tombstone replaces it rather than adding another
+	viper.Set("Tombstones.TTL", time.Hour)
+	s.Tombstone("site", "", 0)
+	s.Tombstone("site", "", 2*time.Hour)
+	if got := s.Tombstones(); len(got) != 1 || time.Until(got[0].Expires) < time.Hour {
+		t.Errorf("tombstones = %v", got)
+	}
+}
+
+func TestTombstoneInvalidName(t *testing.T) {
+	s := newTestState(t)
+	for _, website := range []string{"", "../etc", ".hidden", "a/b"} {
+		if err := s.Tombstone(website, "", 0); err == nil {
+			t.Errorf("Tombstone(%q) should fail", website)
+		}
+	}
+}
+
+func TestParseContentDiffTombstones(t *testing.T) {
+	diff := parseContentDiff([]byte(`{"response": ["site/a"], "tombstones": [{"website": "old", "ttl": 60}]}`))
+	if len(diff.needed) != 1 || len(diff.tombstones) != 1 || diff.tombstones[0] != (tombstoneDirective{Website: "old", TTL: 60}) {
+		t.Errorf("diff = %+v", diff)
+	}
+}
+
+func TestAdvertiseContentDoesNotBlock(t *testing.T) {
+	s := newTestState(t)
+
+	// Removing content queues an update with the lock held, however many
+	done := make(chan struct{})
+	go func() {
+		s.mux.Lock()
+		for i := 0; i < 10; i++ {
+			s.advertiseContent()
+		}
+		s.mux.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("advertiseContent blocked")
+	}
+	if !published(s) || published(s) {
+		t.Fatal("updates should be coalesced into one")
+	}
+}
@@ -0,0 +1,110 @@
+// Package tracing exports OpenTelemetry traces of serving, syncing and calls
+// to the network gateway to an OTLP collector
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/gladiusio/gladius-edged")
+
+// Setup starts exporting traces if tracing is enabled, the returned function
+// flushes and stops the exporter. Trace context is propagated either way.
+func Setup() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !viper.GetBool("Tracing.Enabled") {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(viper.GetString("Tracing.Endpoint"))}
+	if viper.GetBool("Tracing.Insecure") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if urlPath := viper.GetString("Tracing.URLPath"); urlPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(urlPath))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(viper.GetString("Tracing.ServiceName")),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("Tracing.SampleRatio")))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span, marking it failed if err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject adds the trace context to outgoing request headers
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// requestHeaderCarrier reads trace context from fasthttp request headers
+type requestHeaderCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c requestHeaderCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+func (c requestHeaderCarrier) Set(key, value string) {
+	c.header.Set(key, value)
+}
+
+func (c requestHeaderCarrier) Keys() []string {
+	keys := make([]string, 0)
+	c.header.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// StartServer starts a server span for a request, continuing the trace of
+// the caller if it sent one
+func StartServer(ctx *fasthttp.RequestCtx, name string) (context.Context, trace.Span) {
+	parent := otel.GetTextMapPropagator().Extract(context.Background(), requestHeaderCarrier{&ctx.Request.Header})
+	return tracer.Start(parent, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.HTTPRequestMethodKey.String(string(ctx.Method())),
+		semconv.URLPath(string(ctx.Path())),
+		semconv.ClientAddress(ctx.RemoteIP().String()),
+	))
+}
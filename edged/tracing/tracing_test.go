@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	testExporter     = tracetest.NewInMemoryExporter()
+	testExporterOnce sync.Once
+)
+
+// newTestExporter sends spans to memory. Our tracer only picks up the first
+// tracer provider that is set, so every test shares the exporter.
+func newTestExporter(t *testing.T) *tracetest.InMemoryExporter {
+	testExporterOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	testExporter.Reset()
+	return testExporter
+}
+
+func attributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestStartServer(t *testing.T) {
+	exporter := newTestExporter(t)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.SetRequestURI("/content?website=site")
+	ctx.Request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	_, span := StartServer(ctx, "HTTP /content")
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans, want 1", len(spans))
+	}
+	got := spans[0]
+	if got.Name != "HTTP /content" || got.SpanKind != trace.SpanKindServer {
+		t.Errorf("span %q of kind %v", got.Name, got.SpanKind)
+	}
+	if got.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || got.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("trace %v, parent %v, want the caller's trace continued", got.SpanContext.TraceID(), got.Parent.SpanID())
+	}
+	attrs := attributes(got)
+	if attrs["http.request.method"].AsString() != "GET" || attrs["url.path"].AsString() != "/content" {
+		t.Errorf("attributes = %v", got.Attributes)
+	}
+}
+
+func TestEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"success", nil, codes.Unset},
+		{"failure", errors.New("peer went away"), codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := newTestExporter(t)
+			_, span := Start(context.Background(), "download", attribute.String("content.name", "site/a"))
+			End(span, tt.err)
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("%d spans, want 1", len(spans))
+			}
+			if spans[0].Status.Code != tt.want {
+				t.Errorf("status = %v, want %v", spans[0].Status.Code, tt.want)
+			}
+			if attributes(spans[0])["content.name"].AsString() != "site/a" {
+				t.Errorf("attributes = %v", spans[0].Attributes)
+			}
+		})
+	}
+}